@@ -1,3 +1,3 @@
 #!/usr/bin/env bash
-rm db.sqlite
-sqlite3 db.sqlite < migrations/init.sql
\ No newline at end of file
+# the bot creates and migrates the schema when it starts
+rm -f db.sqlite
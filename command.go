@@ -1,96 +1,312 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/diamondburned/arikawa/v3/api"
 	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/state"
 )
 
-func Register(s *state.State, editResponse func(string) error, user discord.UserID, guild discord.GuildID, email string) (string, error) {
+// Register sends a token to email for /verify. Once the email is queued it
+// returns no message, since the outbox responds when it's been sent.
+func Register(s *state.State, app discord.AppID, interactionToken string, requester discord.User, guild discord.GuildID, email string) (string, error) {
+	outcome := "error"
+	defer func() { registerTotal.WithLabelValues(outcome).Inc() }()
+
+	user := requester.ID
+	email, err := parseEmail(email)
+	if err != nil {
+		outcome = "invalid_email"
+		return "Bad formatting of email. Make sure it is correctly typed in and try again.", fmt.Errorf("error parsing email: %w", err)
+	}
 	domain, err := extractDomain(email)
 	if err != nil {
+		outcome = "invalid_email"
 		return "Bad formatting of email. Make sure it is correctly typed in and try again.", fmt.Errorf("error extracting domain: %w", err)
 	}
 	// check if the email is configured for verification
-	role, ok, err := db.GetConfig(guild, domain)
-
+	domains, err := db.EmailDomains(guild)
 	if err != nil {
-		return "", fmt.Errorf("failed to get email domain from DB: %w", err)
-	} else if !ok {
+		return "", fmt.Errorf("failed to get email domains from DB: %w", err)
+	} else if len(domains) == 0 {
+		outcome = "not_configured"
 		return "You need to configure the verifiable emails, ask your admins to set it up.", err
 	}
-	if err := validateEmail(string(domain), email); err != nil {
-		// validateEmail gives helpful errors on invalid emails
-		return err.Error(), nil
+	config, ok := matchDomain(domains, domain)
+	if !ok {
+		outcome = "wrong_domain"
+		patterns := make([]string, len(domains))
+		for i, d := range domains {
+			patterns[i] = d.Domain
+		}
+		return "Email address must be from one of this server's domains: " + strings.Join(patterns, ", "), nil
+	}
+	role := config.Role
+	if local := email[:strings.LastIndex(email, "@")]; strings.Contains(local, "+") && !config.allowsPlus(domain) {
+		outcome = "invalid_email"
+		return "Email address must not be an alias.", nil
 	}
 
-	id, err := MakeIdentifier(guild, email)
+	// aliases of the same inbox get the same identifier, so they can't be
+	// used to verify several accounts or get around a ban
+	canonical := canonicalEmail(domains, email)
+	id, err := MakeIdentifier(guild, canonical)
 	if err != nil {
 		return "", fmt.Errorf("failed making an identifier from the email: %w", err)
 	}
+	// the email may still be stored under other identifiers, which are only
+	// rehashed once /verify proves it's theirs
+	previous, err := previousIdentifiers(guild, config, email)
+	if err != nil {
+		return "", fmt.Errorf("failed making previous identifiers from the email: %w", err)
+	}
 
 	// skip registration if account should already be verified
-	userID, ok, err := db.GetVerifiedEmail(guild, id)
-	if err != nil {
-		return "", fmt.Errorf("error getting user ID from DB during registration: %w", err)
+	var userID discord.UserID
+	banned := false
+	found := false
+	for _, candidate := range append([]Identifier{id}, previous...) {
+		if !found {
+			userID, found, err = db.GetVerifiedEmail(guild, candidate)
+			if err != nil {
+				return "", fmt.Errorf("error getting user ID from DB during registration: %w", err)
+			}
+		}
+		if !banned {
+			banned, err = db.IsBanned(guild, candidate)
+			if err != nil {
+				return "", fmt.Errorf("error checking if user is banned: %w", err)
+			}
+		}
 	}
 
-	if ok && userID == user {
+	// banned users go through /verify like anyone else and are turned away
+	// there
+	if found && userID == user && !banned {
 		ok, err := addVerifiedRole(s, guild, user, role)
 		if err != nil {
 			return "", fmt.Errorf("couldn't verify user: %w", err)
 		} else if !ok {
+			outcome = "not_configured"
 			return "You need to configure the verified role first, ask your admins to set it up.", err
 		}
+		outcome = "welcome_back"
 		return "Welcome back, you have been verified", err
 	}
 
+	// stop people from using the bot to spam others' inboxes
+	retryAt, scope, limited, err := registerRetryAt(guild, user, id)
+	if err != nil {
+		return "", fmt.Errorf("error checking rate limits: %w", err)
+	}
+	if limited {
+		outcome = "rate_limited"
+		return rateLimitMessage(scope, retryAt), nil
+	}
+
+	settings, err := db.GuildSettings(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting guild settings from DB: %w", err)
+	}
+
 	// create random token
 	token := MakeToken()
-	err = db.SetEmailToken(guild, id, token, domain)
+	// tokens remember the pattern that matched, which the role is looked up by
+	err = db.SetEmailToken(guild, user, id, previous, token, config.Domain, time.Now().Add(settings.TokenTTL))
 	if err != nil {
 		return "", fmt.Errorf("error setting token in DB: %v", err)
 	}
 
-	body := formatRegistrationEmail(token)
+	err = db.RecordEmailSend(guild, user, id)
+	if err != nil {
+		return "", fmt.Errorf("error recording email send in DB: %w", err)
+	}
 
-	// first, respond with some sort of "sending..." message
-	// after that, send the email and edit the original message when we know if it succeeded
-	// the bot needs to respond immediately with something, otherwise it'll time out
-	defer func() {
-		go func() {
-			err := SendEmail(email, "Gatekeeper verification", body)
-			if err != nil {
-				log.Printf("error sending email to %v: %v\n", email, err)
-				err = editResponse("⚠️ Error sending email :(")
-				if err != nil {
-					log.Println("failed to send interaction callback:", err)
-				}
-				return
-			} else {
-				const format = "✅ An email has been sent to %v\nPlease use /verify <token> to verify your email address."
-				responseText := fmt.Sprintf(format, email)
-				err = editResponse(responseText)
-				if err != nil {
-					log.Println("failed to send interaction callback:", err)
-				}
-			}
-		}()
-	}()
-	return "⌛ Sending email...", nil
+	tmpl, err := db.EmailTemplate(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting email template from DB: %w", err)
+	}
+	message, err := RenderEmail(tmpl, newEmailData(token, guildName(s, guild), requester.Tag(), settings.TokenTTL))
+	if err != nil {
+		return "", fmt.Errorf("error rendering email template: %w", err)
+	}
+	message.To = email
+
+	// the response has been deferred, and the outbox edits it when it knows
+	// if sending succeeded
+	err = outbox.Enqueue(OutboxEmail{
+		Guild:            guild,
+		User:             user,
+		AppID:            app,
+		InteractionToken: interactionToken,
+		Email:            message,
+	})
+	if err != nil {
+		return "⚠️ Error sending email :(", fmt.Errorf("error adding email to outbox: %w", err)
+	}
+	outcome = "email_queued"
+	return "", nil
+}
+
+// RateLimitScope is what emails sent by /register are counted by.
+type RateLimitScope string
+
+const (
+	RateLimitUser  RateLimitScope = "user"
+	RateLimitEmail RateLimitScope = "email"
+	RateLimitGuild RateLimitScope = "guild"
+)
+
+// RateLimit allows Count emails in any Window. A Count of 0 means unlimited.
+type RateLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+// noun is what the scope is called in messages.
+func (scope RateLimitScope) noun() string {
+	switch scope {
+	case RateLimitEmail:
+		return "email address"
+	case RateLimitGuild:
+		return "server"
+	default:
+		return string(scope)
+	}
+}
+
+var defaultRateLimits = map[RateLimitScope]RateLimit{
+	RateLimitUser:  {Count: 3, Window: time.Hour},
+	RateLimitEmail: {Count: 3, Window: time.Hour},
+	RateLimitGuild: {Count: 100, Window: time.Hour},
+}
+
+// emails are kept around for the longest window a rate limit can have
+const maxRateLimitWindow = 7 * 24 * time.Hour
+
+// registerRetryAt checks each of the guild's rate limits, returning the one
+// that was hit and when /register can be used again.
+func registerRetryAt(guild discord.GuildID, user discord.UserID, id Identifier) (time.Time, RateLimitScope, bool, error) {
+	limits, err := db.RateLimits(guild)
+	if err != nil {
+		return time.Time{}, "", false, err
+	}
+
+	now := time.Now()
+	for _, scope := range []RateLimitScope{RateLimitGuild, RateLimitEmail, RateLimitUser} {
+		limit := limits[scope]
+		if limit.Count <= 0 {
+			continue
+		}
+		sends, err := db.RecentEmailSends(guild, scope, user, id, now.Add(-limit.Window), limit.Count)
+		if err != nil {
+			return time.Time{}, "", false, err
+		}
+		if len(sends) >= limit.Count {
+			// the window slides past the oldest of the last Count emails
+			return sends[len(sends)-1].Add(limit.Window), scope, true, nil
+		}
+	}
+	return time.Time{}, "", false, nil
+}
+
+func rateLimitMessage(scope RateLimitScope, retryAt time.Time) string {
+	var reason string
+	switch scope {
+	case RateLimitUser:
+		reason = "You've requested too many verification emails."
+	case RateLimitEmail:
+		reason = "Too many verification emails have been sent to that address."
+	default:
+		reason = "This server has sent too many verification emails recently."
+	}
+	return fmt.Sprintf("%s Try again <t:%d:R>.", reason, retryAt.Unix())
+}
+
+// formatDuration is like time.Duration.String, but friendlier for the whole
+// minutes and hours that TTLs are configured in.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return pluralize(int(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return pluralize(int(d/time.Minute), "minute")
+	default:
+		return d.String()
+	}
 }
 
-func formatRegistrationEmail(token Token) string {
-	return fmt.Sprintf(
-		"Greetings from Gatekeeper!\n\n"+
-			"Your verification token is: %v", token.String())
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
 }
 
+// LockoutPolicy decides when too many wrong tokens lock someone out of /verify.
+type LockoutPolicy struct {
+	// Limit is how many failures in a row cause a lockout
+	Limit int
+	// Window is how long until a failure is forgotten
+	Window time.Duration
+	// Base is how long the first lockout lasts, each one after that doubles
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Duration returns how long the nth lockout lasts.
+func (p LockoutPolicy) Duration(lockouts int) time.Duration {
+	d := p.Base
+	for i := 1; i < lockouts && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+var userVerifyLockout = LockoutPolicy{
+	Limit:  5,
+	Window: time.Hour,
+	Base:   time.Minute,
+	Max:    24 * time.Hour,
+}
+
+// a lot of wrong tokens across a guild means someone is guessing with more
+// than one account. That doesn't lock anyone out, since people with valid
+// tokens would be locked out too, but moderators are alerted and every wrong
+// token locks its user out straight away until the alert is over.
+var guildVerifyAlert = LockoutPolicy{
+	Limit:  50,
+	Window: 10 * time.Minute,
+	Base:   time.Minute,
+	Max:    time.Hour,
+}
+
+// strictVerifyLockout is used instead of userVerifyLockout during an alert
+var strictVerifyLockout = LockoutPolicy{
+	Limit:  1,
+	Window: time.Hour,
+	Base:   time.Minute,
+	Max:    24 * time.Hour,
+}
+
+// guildWide is the user that failures across a whole guild are counted under,
+// its lockout is when the guild's alert ends
+const guildWide = discord.UserID(0)
+
 func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenString string) (string, error) {
+	outcome := "error"
+	defer func() { verifyTotal.WithLabelValues(outcome).Inc() }()
+
 	var token Token
 	err := (&token).UnmarshalText([]byte(tokenString))
 	if err != nil {
@@ -100,12 +316,42 @@ func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenStr
 	// message may have multiple lines so we use a string builder
 	msg := &strings.Builder{}
 
-	id, role, ok, err := db.GetEmailToken(guild, token)
+	lockedUntil, err := db.VerifyLockedUntil(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error checking verify lockout: %w", err)
+	}
+	if time.Now().Before(lockedUntil) {
+		outcome = "locked_out"
+		return fmt.Sprintf("Too many incorrect tokens have been entered. Try again <t:%d:R>.", lockedUntil.Unix()), nil
+	}
+
+	emailToken, ok, err := db.GetEmailToken(guild, token)
+	if errors.Is(err, ErrTokenExpired) {
+		outcome = "expired"
+		return "Your token has expired, run /register again to get a new one.", nil
+	}
 	if err != nil {
 		return "", fmt.Errorf("error getting token from db: %w", err)
 	}
 	if !ok {
-		return "Your token is incorrect.", nil
+		outcome = "wrong_token"
+		return verifyFailed(s, guild, user, "Your token is incorrect.")
+	}
+	// tokens can only be used by whoever asked for them, in case the email
+	// was forwarded or the token was pasted somewhere public
+	if emailToken.User != user {
+		outcome = "wrong_user"
+		return verifyFailed(s, guild, user, "This token was sent to a different account. Use /register to get your own token.")
+	}
+	id, role := emailToken.Identifier, emailToken.Role
+
+	// now that they've proven they own the email, anything stored under its
+	// other identifiers can be moved to this one, including bans
+	for _, old := range emailToken.Previous {
+		err = db.RehashIdentifier(guild, old, id)
+		if err != nil {
+			return "", fmt.Errorf("error rehashing identifier in DB: %w", err)
+		}
 	}
 
 	// put ban check after verification to prevent banned email enumeration
@@ -114,6 +360,7 @@ func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenStr
 		return "", fmt.Errorf("error checking if user is banned: %w", err)
 	}
 	if banned {
+		outcome = "banned"
 		return "You have been banned and are unable to verify.", nil
 	}
 
@@ -131,6 +378,7 @@ func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenStr
 			oldUser, _ := s.User(oldUser)
 			return "", fmt.Errorf("error removing verified user: %v#%v", oldUser.Username, oldUser.Discriminator)
 		} else if !ok {
+			outcome = "not_configured"
 			return "You need to configure the verified role first, ask your admins to set it up.", err
 		} else {
 			fmt.Fprintf(msg, "Your email was also used to verify <@%v>. That account has been unverified.\n", oldUser)
@@ -147,6 +395,7 @@ func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenStr
 	if err != nil {
 		return "", fmt.Errorf("couldn't verify user: %w", err)
 	} else if !ok {
+		outcome = "not_configured"
 		return "You need to configure the verified role first, ask your admins to set it up.", err
 	}
 
@@ -154,16 +403,89 @@ func Verify(s *state.State, user discord.UserID, guild discord.GuildID, tokenStr
 	if err != nil {
 		return "", fmt.Errorf("error deleting token in DB: %w", err)
 	}
-	err = db.SetVerifiedEmail(guild, id, user, role)
+	err = db.SetVerifiedEmail(guild, id, user, role, emailToken.Domain)
 	if err != nil {
 		return "", fmt.Errorf("error verifying user in DB: %w", err)
 	}
 
+	err = db.ResetVerifyFailures(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error resetting failed verifications in DB: %w", err)
+	}
+
 	msg.WriteString("Congrats! You've been verified!\n")
+	outcome = "verified"
+	if hasOldUser {
+		outcome = "replaced"
+	}
 
 	return strings.TrimSpace(msg.String()), nil
 }
 
+// verifyFailed counts a wrong token against the user and the guild, and
+// locks the user out of /verify if there have been too many.
+func verifyFailed(s *state.State, guild discord.GuildID, user discord.UserID, msg string) (string, error) {
+	alertUntil, err := db.VerifyLockedUntil(guild, guildWide)
+	if err != nil {
+		return "", fmt.Errorf("error checking verify alert: %w", err)
+	}
+	policy := userVerifyLockout
+	if time.Now().Before(alertUntil) {
+		policy = strictVerifyLockout
+	}
+
+	lockedUntil, locked, err := db.RecordVerifyFailure(guild, user, policy)
+	if err != nil {
+		return "", fmt.Errorf("error recording failed verification: %w", err)
+	}
+	if locked {
+		// the user can't be trusted with their tokens anymore
+		err = db.DeleteUserTokens(guild, user)
+		if err != nil {
+			return "", fmt.Errorf("error invalidating tokens: %w", err)
+		}
+		modLog(s, guild, fmt.Sprintf(
+			"🔒 <@%v> entered too many incorrect tokens. They are locked out of /verify until <t:%d:f> and their pending tokens were cancelled.",
+			user, lockedUntil.Unix()))
+		msg = fmt.Sprintf(
+			"%s\nYou've entered too many incorrect tokens, so your pending tokens were cancelled. Try again <t:%d:R>.",
+			msg, lockedUntil.Unix())
+	}
+
+	alertUntil, alerted, err := db.RecordVerifyFailure(guild, guildWide, guildVerifyAlert)
+	if err != nil {
+		return "", fmt.Errorf("error recording failed verification: %w", err)
+	}
+	if alerted {
+		modLog(s, guild, fmt.Sprintf(
+			"🚨 Unusually many incorrect tokens have been entered across the server, someone may be guessing with several accounts. Until <t:%d:f>, anyone who enters an incorrect token is locked out of /verify straight away.",
+			alertUntil.Unix()))
+	}
+
+	return msg, nil
+}
+
+// modLog posts msg to the guild's mod log, if it has one. Failing to post
+// isn't worth failing a command over, so errors are only logged.
+func modLog(s *state.State, guild discord.GuildID, msg string) {
+	settings, err := db.GuildSettings(guild)
+	if err != nil {
+		slog.Error("error getting mod log channel", "guild", guild, "err", err)
+		return
+	}
+	if !settings.ModLogChannel.IsValid() {
+		return
+	}
+	_, err = s.SendMessageComplex(settings.ModLogChannel, api.SendMessageData{
+		Content: msg,
+		// mod log messages are for reading, not for pinging people
+		AllowedMentions: &api.AllowedMentions{Parse: []api.AllowedMentionType{}},
+	})
+	if err != nil {
+		slog.Error("error sending to mod log", "guild", guild, "err", err)
+	}
+}
+
 func addVerifiedRole(s *state.State, guild discord.GuildID, user discord.UserID, role discord.RoleID) (bool, error) {
 	return true, s.AddRole(guild, user, role, api.AddRoleData{AuditLogReason: api.AuditLogReason("Gatekeeper verification")})
 }
@@ -179,7 +501,19 @@ func removeVerifiedRole(s *state.State, guild discord.GuildID, user discord.User
 	return true, s.RemoveRole(guild, user, role, api.AuditLogReason("Gatekeeper verification"))
 }
 
-func Ban(s *state.State, user discord.UserID, guild discord.GuildID) (string, error) {
+// maxBanReason is how many characters of a ban reason are kept
+const maxBanReason = 500
+
+// maxBanDays is the longest temporary ban, anything longer may as well be
+// permanent
+const maxBanDays = 10 * 365
+
+// Ban unverifies the user and bans every email they verified with. A duration
+// of zero bans them forever.
+func Ban(s *state.State, moderator discord.UserID, user discord.UserID, guild discord.GuildID, reason string, duration time.Duration) (string, error) {
+	outcome := "error"
+	defer func() { banTotal.WithLabelValues("user", outcome).Inc() }()
+
 	// a user can potentially have multiple verified roles for multiple domains in a single guild
 	identifiers, err := db.GetUserIdentifiers(guild, user)
 	if err != nil {
@@ -187,15 +521,391 @@ func Ban(s *state.State, user discord.UserID, guild discord.GuildID) (string, er
 	}
 
 	if len(identifiers) == 0 {
+		outcome = "not_verified"
 		return fmt.Sprintf("Error: user <@%v> not verified", user), nil
 	}
 
+	var expiresAt time.Time
+	var kept bool
 	for _, id := range identifiers {
-		err = db.BanEmail(guild, id)
+		ban := newBanRecord(moderator, guild, id, reason, duration)
+		ban.User = user
+		_, expiresAt, err = db.BanEmail(ban)
 		if err != nil {
 			return "", fmt.Errorf("error banning id in DB: %w", err)
 		}
+		// bans are stored to the second
+		kept = kept || expiresAt.Unix() != ban.ExpiresAt.Unix()
+
+		ok, err := removeVerifiedRole(s, guild, user, id)
+		if err != nil {
+			return "", fmt.Errorf("couldn't unverify user: %w", err)
+		} else if !ok {
+			outcome = "not_configured"
+			return "You need to configure the verified role first, ask your admins to set it up.", err
+		}
+		err = db.DeleteVerifiedEmail(guild, id)
+		if err != nil {
+			return "", fmt.Errorf("error unverifying user in DB: %w", err)
+		}
+	}
+	outcome = "banned"
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "Success! User <@%v> was banned", user)
+	writeBanExpiry(msg, expiresAt, kept)
+	return msg.String(), nil
+}
+
+// writeBanExpiry finishes a ban's success message with when it ends, and
+// whether an existing ban that lasts longer was kept instead.
+func writeBanExpiry(msg *strings.Builder, expiresAt time.Time, kept bool) {
+	if !expiresAt.IsZero() {
+		fmt.Fprintf(msg, " until <t:%d:f>", expiresAt.Unix())
+	}
+	msg.WriteString(".")
+	if kept {
+		msg.WriteString(" There was already a ban that lasts longer, so it was kept.")
+	}
+}
+
+// BanEmailAddress bans an email whether or not anyone has verified with it,
+// without storing the address itself.
+func BanEmailAddress(s *state.State, moderator discord.UserID, guild discord.GuildID, email string, reason string, duration time.Duration) (string, error) {
+	outcome := "error"
+	defer func() { banTotal.WithLabelValues("email", outcome).Inc() }()
+
+	email, err := parseEmail(email)
+	if err != nil {
+		outcome = "invalid_email"
+		return "Bad formatting of email. Make sure it is correctly typed in and try again.", nil
+	}
+	domains, err := db.EmailDomains(guild)
+	if err != nil {
+		return "", fmt.Errorf("failed to get email domains from DB: %w", err)
+	}
+	id, previous, err := emailIdentifiers(guild, domains, email)
+	if err != nil {
+		return "", err
+	}
+
+	ban := newBanRecord(moderator, guild, id, reason, duration)
+	users, expiresAt, err := banIdentifier(s, ban, previous)
+	if err != nil {
+		return "", err
+	}
+
+	outcome = "banned"
+	msg := &strings.Builder{}
+	msg.WriteString("Success! That email was banned")
+	writeBanExpiry(msg, expiresAt, expiresAt.Unix() != ban.ExpiresAt.Unix())
+	for _, user := range users {
+		fmt.Fprintf(msg, " It was used to verify <@%v>, who has been unverified.", user)
+	}
+	return msg.String(), nil
+}
+
+// maxBanImportSize is the largest file of emails /ban will download
+const maxBanImportSize = 1 << 20
+
+// maxBanImport is how many emails can be banned from one file. Each one
+// takes up to six Argon2 hashes of around 100ms, so an import can take up to
+// five minutes, well within the 15 minutes its response can be edited for.
+const maxBanImport = 500
+
+var attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+// BanImport bans every email address in a text or CSV file attached to the
+// command. It can take a while, so it's meant to be run after the
+// interaction has been deferred.
+func BanImport(s *state.State, moderator discord.UserID, guild discord.GuildID, file discord.Attachment, reason string, duration time.Duration) (string, error) {
+	outcome := "error"
+	defer func() { banTotal.WithLabelValues("file", outcome).Inc() }()
+
+	if file.Size > maxBanImportSize {
+		outcome = "invalid_file"
+		return fmt.Sprintf("That file is too big, it can be at most %d KB.", maxBanImportSize>>10), nil
+	}
+
+	res, err := attachmentClient.Get(file.URL)
+	if err != nil {
+		return "", fmt.Errorf("error downloading ban list: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading ban list: %s", res.Status)
+	}
+
+	emails, invalid, err := parseEmailList(io.LimitReader(res.Body, maxBanImportSize))
+	if err != nil {
+		outcome = "invalid_file"
+		return "That file couldn't be read. It should be a text file with one email per line, or a CSV file.", nil
+	}
+	if len(emails) == 0 {
+		outcome = "invalid_file"
+		return "There weren't any email addresses in that file.", nil
+	}
+	if len(emails) > maxBanImport {
+		outcome = "invalid_file"
+		return fmt.Sprintf("That file has %d email addresses, but at most %d can be banned at once. Split it up and try again.", len(emails), maxBanImport), nil
+	}
+
+	domains, err := db.EmailDomains(guild)
+	if err != nil {
+		return "", fmt.Errorf("failed to get email domains from DB: %w", err)
+	}
+
+	var unverified int
+	for _, email := range emails {
+		id, previous, err := emailIdentifiers(guild, domains, email)
+		if err != nil {
+			return "", err
+		}
+		users, _, err := banIdentifier(s, newBanRecord(moderator, guild, id, reason, duration), previous)
+		if err != nil {
+			return "", err
+		}
+		unverified += len(users)
+	}
+
+	outcome = "banned"
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "Success! Banned %s.", pluralize(len(emails), "email"))
+	if unverified > 0 {
+		fmt.Fprintf(msg, " Accounts that verified with them were unverified: %d.", unverified)
+	}
+	if invalid > 0 {
+		fmt.Fprintf(msg, " Invalid addresses that were skipped: %d.", invalid)
+	}
+	return msg.String(), nil
+}
+
+// emailIdentifiers makes the identifier for an email that a moderator typed
+// in, and the other identifiers it may already be stored under. Those are
+// left alone until the email's owner verifies, so moderators looking at an
+// email never change what's stored.
+func emailIdentifiers(guild discord.GuildID, domains []DomainConfig, email string) (Identifier, []Identifier, error) {
+	canonical := canonicalEmail(domains, email)
+	id, err := MakeIdentifier(guild, canonical)
+	if err != nil {
+		return Identifier{}, nil, fmt.Errorf("failed making an identifier from the email: %w", err)
+	}
+	config, _ := matchDomain(domains, email[strings.LastIndex(email, "@")+1:])
+	previous, err := previousIdentifiers(guild, config, email)
+	if err != nil {
+		return Identifier{}, nil, fmt.Errorf("failed making previous identifiers from the email: %w", err)
+	}
+	return id, previous, nil
+}
+
+func newBanRecord(moderator discord.UserID, guild discord.GuildID, id Identifier, reason string, duration time.Duration) BanRecord {
+	if reasonRunes := []rune(reason); len(reasonRunes) > maxBanReason {
+		reason = string(reasonRunes[:maxBanReason])
+	}
+	ban := BanRecord{
+		Guild:      guild,
+		Identifier: id,
+		Moderator:  moderator,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+	if duration > 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(duration)
+	}
+	return ban
+}
+
+// banIdentifier bans ban.Identifier, and unverifies whoever verified with it
+// or with any of the other identifiers the email may be stored under. It
+// returns the users that were unverified, and when the ban expires.
+func banIdentifier(s *state.State, ban BanRecord, previous []Identifier) ([]discord.UserID, time.Time, error) {
+	var users []discord.UserID
+	var identifiers []Identifier
+	for _, id := range append([]Identifier{ban.Identifier}, previous...) {
+		user, verified, err := db.GetVerifiedEmail(ban.Guild, id)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("error getting user from DB: %w", err)
+		}
+		if verified {
+			users = append(users, user)
+			identifiers = append(identifiers, id)
+		}
+	}
+	if len(users) > 0 {
+		ban.User = users[0]
+	}
+
+	_, expiresAt, err := db.BanEmail(ban)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error banning id in DB: %w", err)
+	}
+
+	for i, user := range users {
+		_, err = removeVerifiedRole(s, ban.Guild, user, identifiers[i])
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("couldn't unverify user: %w", err)
+		}
+		err = db.DeleteVerifiedEmail(ban.Guild, identifiers[i])
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("error unverifying user in DB: %w", err)
+		}
+	}
+	return users, expiresAt, nil
+}
+
+// purgeExpiredBans deletes temporary bans that are over, and lets each
+// guild's mod log know whose ban ended.
+func purgeExpiredBans(s *state.State) {
+	bans, err := db.PurgeExpiredBans(time.Now())
+	if err != nil {
+		slog.Error("error purging expired bans", "err", err)
+		return
+	}
+	for _, ban := range bans {
+		who := "An email address"
+		if ban.User.IsValid() {
+			who = fmt.Sprintf("<@%v>", ban.User)
+		}
+		modLog(s, ban.Guild, fmt.Sprintf("⏰ %s's ban (ID %d) has expired, so they can verify again.", who, ban.ID))
+	}
+}
+
+// Status describes the user's own verification state. It only has
+// identifiers to go on, so it can never show which email was used.
+func Status(s *state.State, user discord.UserID, guild discord.GuildID) (string, error) {
+	verifications, err := db.UserVerifications(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error getting verifications from DB: %w", err)
+	}
+	pendingUntil, pending, err := db.PendingTokenExpiry(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error getting pending tokens from DB: %w", err)
+	}
+
+	msg := &strings.Builder{}
+	if len(verifications) == 0 {
+		msg.WriteString("You aren't verified.")
+		if !pending {
+			msg.WriteString(" Use /register to get started.")
+		}
+		msg.WriteByte('\n')
+	}
+	for _, v := range verifications {
+		msg.WriteString("✅ Verified with ")
+		if v.Domain != "" {
+			fmt.Fprintf(msg, "a %s email", v.Domain)
+		} else {
+			msg.WriteString("an email")
+		}
+		if !v.VerifiedAt.IsZero() {
+			fmt.Fprintf(msg, " <t:%d:R>", v.VerifiedAt.Unix())
+		}
+		fmt.Fprintf(msg, ", which gave you <@&%v>.", v.Role)
+		if v.Domain != "" {
+			_, configured, err := db.GetConfig(guild, v.Domain)
+			if err != nil {
+				return "", fmt.Errorf("error getting config from DB: %w", err)
+			}
+			if !configured {
+				msg.WriteString(" That domain is no longer used for verification.")
+			}
+		}
+		msg.WriteByte('\n')
+	}
+	if pending {
+		fmt.Fprintf(msg, "⌛ You have a token from /register that expires <t:%d:R>. Use /verify to finish verifying.\n", pendingUntil.Unix())
+	}
+	return strings.TrimSpace(msg.String()), nil
+}
+
+// Lookup finds the account that verified with an email. Every lookup is
+// audited, and nothing is shown if the audit can't be written.
+func Lookup(s *state.State, moderator discord.UserID, guild discord.GuildID, email string) (string, error) {
+	email, err := parseEmail(email)
+	if err != nil {
+		return "Bad formatting of email. Make sure it is correctly typed in and try again.", nil
+	}
+	domains, err := db.EmailDomains(guild)
+	if err != nil {
+		return "", fmt.Errorf("failed to get email domains from DB: %w", err)
+	}
+	id, previous, err := emailIdentifiers(guild, domains, email)
+	if err != nil {
+		return "", err
+	}
+
+	// the email may be stored under any of its identifiers
+	var user discord.UserID
+	var verified, banned bool
+	var verifiedID Identifier
+	var ban BanRecord
+	for _, candidate := range append([]Identifier{id}, previous...) {
+		if !verified {
+			user, verified, err = db.GetVerifiedEmail(guild, candidate)
+			if err != nil {
+				return "", fmt.Errorf("error getting user from DB: %w", err)
+			}
+			verifiedID = candidate
+		}
+		if !banned {
+			ban, banned, err = db.GetBan(guild, candidate)
+			if err != nil {
+				return "", fmt.Errorf("error getting ban from DB: %w", err)
+			}
+		}
+	}
+
+	found := discord.UserID(0)
+	if verified {
+		found = user
+	}
+	err = db.RecordLookup(guild, moderator, id, found)
+	if err != nil {
+		return "", fmt.Errorf("error auditing lookup in DB: %w", err)
+	}
+	modLog(s, guild, fmt.Sprintf("🔍 <@%v> looked up an email with /lookup.", moderator))
+
+	msg := &strings.Builder{}
+	if verified {
+		fmt.Fprintf(msg, "That email is verified by <@%v>", user)
+		verifications, err := db.UserVerifications(guild, user)
+		if err != nil {
+			return "", fmt.Errorf("error getting verifications from DB: %w", err)
+		}
+		for _, v := range verifications {
+			if v.Identifier == verifiedID && !v.VerifiedAt.IsZero() {
+				fmt.Fprintf(msg, ", since <t:%d:f>", v.VerifiedAt.Unix())
+			}
+		}
+		msg.WriteString(".\n")
+	} else {
+		msg.WriteString("Nobody is verified with that email.\n")
+	}
+	if banned {
+		fmt.Fprintf(msg, "It is banned: %s\n", formatBan(ban))
+	} else {
+		msg.WriteString("It isn't banned.\n")
+	}
+	return strings.TrimSpace(msg.String()), nil
+}
+
+// Unverify removes the user's verified roles and forgets which emails they
+// verified with, without banning the emails. moderator is the user that asked
+// for it, which is the user themselves when they're unlinking their own email.
+func Unverify(s *state.State, moderator discord.UserID, user discord.UserID, guild discord.GuildID) (string, error) {
+	identifiers, err := db.GetUserIdentifiers(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error getting identifier from DB: %w", err)
+	}
+	self := moderator == user
+
+	if len(identifiers) == 0 {
+		if self {
+			return "You aren't verified.", nil
+		}
+		return fmt.Sprintf("<@%v> isn't verified.", user), nil
+	}
 
+	for _, id := range identifiers {
 		ok, err := removeVerifiedRole(s, guild, user, id)
 		if err != nil {
 			return "", fmt.Errorf("couldn't unverify user: %w", err)
@@ -207,13 +917,370 @@ func Ban(s *state.State, user discord.UserID, guild discord.GuildID) (string, er
 			return "", fmt.Errorf("error unverifying user in DB: %w", err)
 		}
 	}
-	return fmt.Sprintf("Success! User <@%v> was banned.", user), nil
+
+	if self {
+		slog.Info("user unverified themselves", "guild", guild, "user", user)
+		modLog(s, guild, fmt.Sprintf("🔓 <@%v> unlinked their email and is no longer verified.", user))
+		return "Your email has been unlinked. You can use /register to verify with a different email.", nil
+	}
+	slog.Info("user was unverified", "guild", guild, "user", user, "moderator", moderator)
+	modLog(s, guild, fmt.Sprintf("🔓 <@%v> unverified <@%v>.", moderator, user))
+	return fmt.Sprintf("Success! <@%v> is no longer verified.", user), nil
 }
 
-func Config(s *state.State, guild discord.GuildID, domain string, role discord.RoleID) (string, error) {
-	err := db.UpdateConfig(guild, domain, role)
+// Unban lifts the bans on every email the user was verified with. They
+// aren't reverified, they have to run /register again.
+func Unban(s *state.State, user discord.UserID, guild discord.GuildID) (string, error) {
+	n, err := db.UnbanUser(guild, user)
+	if err != nil {
+		return "", fmt.Errorf("error unbanning user in DB: %w", err)
+	}
+	if n == 0 {
+		return fmt.Sprintf("<@%v> isn't banned.", user), nil
+	}
+	return fmt.Sprintf("Success! <@%v> was unbanned and can verify again.", user), nil
+}
+
+func UnbanID(s *state.State, id int64, guild discord.GuildID) (string, error) {
+	ok, err := db.UnbanID(guild, id)
+	if err != nil {
+		return "", fmt.Errorf("error unbanning id in DB: %w", err)
+	}
+	if !ok {
+		return fmt.Sprintf("There's no ban with ID %d, check /bans list.", id), nil
+	}
+	return fmt.Sprintf("Success! Ban %d was removed.", id), nil
+}
+
+// bansPerPage is how many bans /bans list shows at once, which keeps the
+// message under Discord's length limit
+const bansPerPage = 10
+
+// ListBans shows a page of the guild's bans, starting from page 1.
+func ListBans(s *state.State, guild discord.GuildID, page int) (string, error) {
+	total, err := db.CountBans(guild)
+	if err != nil {
+		return "", fmt.Errorf("error counting bans in DB: %w", err)
+	}
+	if total == 0 {
+		return "Nobody is banned.", nil
+	}
+	pages := (total + bansPerPage - 1) / bansPerPage
+	if page > pages {
+		return fmt.Sprintf("There are only %s of bans.", pluralize(pages, "page")), nil
+	}
+
+	bans, err := db.Bans(guild, bansPerPage, (page-1)*bansPerPage)
+	if err != nil {
+		return "", fmt.Errorf("error listing bans from DB: %w", err)
+	}
+
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "**Bans** (page %d of %d, %s in total)\n", page, pages, pluralize(total, "ban"))
+	for _, ban := range bans {
+		msg.WriteString(formatBan(ban))
+		msg.WriteByte('\n')
+	}
+	if page < pages {
+		fmt.Fprintf(msg, "Use `/bans list page:%d` to see more.", page+1)
+	}
+	return strings.TrimSpace(msg.String()), nil
+}
+
+func formatBan(ban BanRecord) string {
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "`%d` ", ban.ID)
+	if ban.User.IsValid() {
+		fmt.Fprintf(msg, "<@%v>", ban.User)
+	} else {
+		msg.WriteString("an email address")
+	}
+	if ban.Moderator.IsValid() {
+		fmt.Fprintf(msg, " by <@%v>", ban.Moderator)
+	}
+	if !ban.CreatedAt.IsZero() {
+		fmt.Fprintf(msg, " <t:%d:R>", ban.CreatedAt.Unix())
+	}
+	if !ban.ExpiresAt.IsZero() {
+		fmt.Fprintf(msg, ", expires <t:%d:R>", ban.ExpiresAt.Unix())
+	}
+	if ban.Reason != "" {
+		fmt.Fprintf(msg, ": %s", ban.Reason)
+	}
+	return msg.String()
+}
+
+// ConfigDomainAdd lets emails from domain verify for role, or changes the
+// role if the domain is already configured.
+func ConfigDomainAdd(s *state.State, guild discord.GuildID, domain string, role discord.RoleID) (string, error) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return "That doesn't look like an email domain, it should be something like example.com or *.example.com.", nil
+	}
+	err = db.UpdateConfig(guild, domain, role)
 	if err != nil {
 		return "", fmt.Errorf("error updating config in DB: %w", err)
 	}
-	return "Successfully updated config!", nil
+	return fmt.Sprintf("Successfully updated config! %s emails now give <@&%v>.", domain, role), nil
+}
+
+// ConfigDomainRemove stops domain from being used to verify. Tokens that were
+// emailed for it have to go too, so unless cancelTokens is set, it asks first
+// if there are any.
+func ConfigDomainRemove(s *state.State, guild discord.GuildID, domain string, cancelTokens bool) (string, error) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return "That doesn't look like an email domain, check `/config domain list`.", nil
+	}
+	_, ok, err := db.GetConfig(guild, domain)
+	if err != nil {
+		return "", fmt.Errorf("error getting config from DB: %w", err)
+	}
+	if !ok {
+		return fmt.Sprintf("%s isn't configured, check `/config domain list`.", domain), nil
+	}
+
+	tokens, err := db.CountDomainTokens(guild, domain)
+	if err != nil {
+		return "", fmt.Errorf("error counting tokens in DB: %w", err)
+	}
+	if tokens > 0 && !cancelTokens {
+		return fmt.Sprintf("Pending tokens for %s: %d. Removing it cancels them, run `/config domain remove domain:%s cancel-tokens:True` to go ahead.",
+			domain, tokens, domain), nil
+	}
+	if tokens > 0 {
+		err = db.DeleteDomainTokens(guild, domain)
+		if err != nil {
+			return "", fmt.Errorf("error deleting tokens in DB: %w", err)
+		}
+	}
+
+	err = db.DeleteConfig(guild, domain)
+	if err != nil {
+		return "", fmt.Errorf("error deleting config in DB: %w", err)
+	}
+	return fmt.Sprintf("Successfully updated config! %s emails can no longer be used to verify. Members who already verified with one keep their role.", domain), nil
+}
+
+func ConfigDomainList(s *state.State, guild discord.GuildID) (string, error) {
+	domains, err := db.EmailDomains(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting config from DB: %w", err)
+	}
+	if len(domains) == 0 {
+		return "No domains are configured yet, add one with `/config domain add`.", nil
+	}
+	return formatDomains(domains), nil
+}
+
+func formatDomains(domains []DomainConfig) string {
+	msg := &strings.Builder{}
+	for _, domain := range domains {
+		fmt.Fprintf(msg, "• %s gives <@&%v>", domain.Domain, domain.Role)
+		if domain.Rules != nil {
+			fmt.Fprintf(msg, " (%s)", formatMailboxRules(*domain.Rules))
+		}
+		msg.WriteByte('\n')
+	}
+	return strings.TrimSpace(msg.String())
+}
+
+func formatMailboxRules(rules MailboxRules) string {
+	var parts []string
+	if rules.TagSeparators != "" {
+		parts = append(parts, fmt.Sprintf("ignores tags after %s", strings.Join(strings.Split(rules.TagSeparators, ""), " or ")))
+	}
+	if rules.IgnoreDots {
+		parts = append(parts, "ignores dots")
+	}
+	if len(parts) == 0 {
+		return "exact addresses"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ConfigDomainMailbox sets how addresses of a configured domain are
+// canonicalized before they're turned into identifiers.
+func ConfigDomainMailbox(s *state.State, guild discord.GuildID, domain string, rules *MailboxRules) (string, error) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return "That doesn't look like an email domain, check `/config domain list`.", nil
+	}
+	_, ok, err := db.GetConfig(guild, domain)
+	if err != nil {
+		return "", fmt.Errorf("error getting config from DB: %w", err)
+	}
+	if !ok {
+		return fmt.Sprintf("%s isn't configured, check `/config domain list`.", domain), nil
+	}
+
+	err = db.SetMailboxRules(guild, domain, rules)
+	if err != nil {
+		return "", fmt.Errorf("error updating mailbox rules in DB: %w", err)
+	}
+	if rules == nil {
+		return fmt.Sprintf("Successfully updated config! %s uses the built-in mailbox rules again.", domain), nil
+	}
+	return fmt.Sprintf("Successfully updated config! %s %s. Emails verified or banned under the built-in rules still count, but not ones from rules set before this.", domain, formatMailboxRules(*rules)), nil
+}
+
+// ConfigShow sums up everything that's configured for the guild.
+func ConfigShow(s *state.State, guild discord.GuildID) (string, error) {
+	domains, err := db.EmailDomains(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting config from DB: %w", err)
+	}
+	settings, err := db.GuildSettings(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting guild settings from DB: %w", err)
+	}
+	limits, err := db.RateLimits(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting rate limits from DB: %w", err)
+	}
+	tmpl, err := db.EmailTemplate(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting email template from DB: %w", err)
+	}
+
+	msg := &strings.Builder{}
+	msg.WriteString("**Domains**\n")
+	if len(domains) == 0 {
+		msg.WriteString("None yet, add one with `/config domain add`.")
+	} else {
+		msg.WriteString(formatDomains(domains))
+	}
+
+	fmt.Fprintf(msg, "\n**Tokens** expire after %v\n", formatDuration(settings.TokenTTL))
+
+	msg.WriteString("**Rate limits**\n")
+	for _, scope := range []RateLimitScope{RateLimitUser, RateLimitEmail, RateLimitGuild} {
+		limit := limits[scope]
+		if limit.Count <= 0 {
+			fmt.Fprintf(msg, "• no limit per %s\n", scope.noun())
+		} else {
+			fmt.Fprintf(msg, "• %s per %s every %v\n", pluralize(limit.Count, "email"), scope.noun(), formatDuration(limit.Window))
+		}
+	}
+
+	if settings.ModLogChannel.IsValid() {
+		fmt.Fprintf(msg, "**Mod log** <#%v>\n", settings.ModLogChannel)
+	} else {
+		msg.WriteString("**Mod log** disabled\n")
+	}
+
+	if tmpl == (EmailTemplate{}) {
+		msg.WriteString("**Email template** default\n")
+	} else {
+		msg.WriteString("**Email template** customized, see `/config template preview`\n")
+	}
+	return strings.TrimSpace(msg.String()), nil
+}
+
+func ConfigTokenTTL(s *state.State, guild discord.GuildID, ttl time.Duration) (string, error) {
+	err := db.SetTokenTTL(guild, ttl)
+	if err != nil {
+		return "", fmt.Errorf("error updating token TTL in DB: %w", err)
+	}
+	return fmt.Sprintf("Successfully updated config! Tokens now expire after %v.", formatDuration(ttl)), nil
+}
+
+func ConfigModLog(s *state.State, guild discord.GuildID, channel discord.ChannelID) (string, error) {
+	err := db.SetModLogChannel(guild, channel)
+	if err != nil {
+		return "", fmt.Errorf("error updating mod log in DB: %w", err)
+	}
+	if !channel.IsValid() {
+		return "Successfully updated config! The mod log is now disabled.", nil
+	}
+	return fmt.Sprintf("Successfully updated config! The mod log is now <#%v>.", channel), nil
+}
+
+func ConfigRateLimit(s *state.State, guild discord.GuildID, scope RateLimitScope, limit RateLimit) (string, error) {
+	err := db.SetRateLimit(guild, scope, limit)
+	if err != nil {
+		return "", fmt.Errorf("error updating rate limit in DB: %w", err)
+	}
+	if limit.Count <= 0 {
+		return fmt.Sprintf("Successfully updated config! Emails per %s are no longer limited.", scope.noun()), nil
+	}
+	return fmt.Sprintf("Successfully updated config! Now allowing %s per %s every %v.",
+		pluralize(limit.Count, "email"), scope.noun(), formatDuration(limit.Window)), nil
+}
+
+// ConfigTemplate changes the fields of the guild's email template that
+// aren't nil, checking that the result still renders with the token in it.
+func ConfigTemplate(s *state.State, guild discord.GuildID, requester discord.User, subject, intro, support, text, html *string) (string, error) {
+	tmpl, err := db.EmailTemplate(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting email template from DB: %w", err)
+	}
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{subject, &tmpl.Subject},
+		{intro, &tmpl.Intro},
+		{support, &tmpl.SupportContact},
+		{text, &tmpl.Text},
+		{html, &tmpl.HTML},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+
+	err = CheckEmailTemplate(tmpl, sampleEmailData(guildName(s, guild), requester.Tag()))
+	if err != nil {
+		return fmt.Sprintf("That template doesn't work: %v", err), nil
+	}
+
+	err = db.SetEmailTemplate(guild, tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error updating email template in DB: %w", err)
+	}
+	return "Successfully updated the email template! Use `/config template preview` to see it.", nil
+}
+
+// how much of each part of the email a preview shows, which keeps it under
+// discord's 2000 character message limit
+const (
+	maxPreviewSubject = 200
+	maxPreviewText    = 800
+	maxPreviewHTML    = 800
+)
+
+func ConfigTemplatePreview(s *state.State, guild discord.GuildID, requester discord.User) (string, error) {
+	tmpl, err := db.EmailTemplate(guild)
+	if err != nil {
+		return "", fmt.Errorf("error getting email template from DB: %w", err)
+	}
+	email, err := RenderEmail(tmpl, sampleEmailData(guildName(s, guild), requester.Tag()))
+	if err != nil {
+		return fmt.Sprintf("The email template doesn't work: %v", err), nil
+	}
+
+	return fmt.Sprintf("**Subject:** %s\n```\n%s\n```\n**HTML:**\n```html\n%s\n```",
+		truncateRunes(email.Subject, maxPreviewSubject),
+		truncateRunes(email.Body, maxPreviewText),
+		truncateRunes(email.HTML, maxPreviewHTML)), nil
+}
+
+func ConfigTemplateReset(s *state.State, guild discord.GuildID) (string, error) {
+	err := db.DeleteEmailTemplate(guild)
+	if err != nil {
+		return "", fmt.Errorf("error deleting email template from DB: %w", err)
+	}
+	return "Successfully reset the email template to the default!", nil
+}
+
+// guildName falls back to something generic, since a missing name isn't worth
+// failing over.
+func guildName(s *state.State, guild discord.GuildID) string {
+	g, err := s.Guild(guild)
+	if err != nil {
+		slog.Warn("error getting guild", "guild", guild, "err", err)
+		return "your server"
+	}
+	return g.Name
 }
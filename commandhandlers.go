@@ -1,8 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/diamondburned/arikawa/v3/api"
@@ -10,6 +13,7 @@ import (
 	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/diamondburned/arikawa/v3/state"
 	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
 )
 
 type CommandHandler func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse
@@ -67,21 +71,27 @@ var commandsGlobal = []Command{
 			},
 		},
 		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
-			email := options.Find("email")
-
-			editResponse := func(newContent string) error {
-				editedResponseData := api.EditInteractionResponseData{Content: option.NewNullableString(newContent)}
-				_, err := s.EditInteractionResponse(e.AppID, e.Token, editedResponseData)
-				return err
+			// exit early if in DMs somehow
+			if e.Member == nil {
+				return nil
 			}
 
-			// lowercase the email, trim whitespace
-			msg, err := Register(s, editResponse, e.SenderID(), e.GuildID, strings.TrimSpace(strings.ToLower(email.String())))
-			if err != nil {
-				log.Println("registration error:", err)
-				// user-facing error and success is handled in Register()'s defer func()
-			}
-			return makeEphemeralResponse(msg)
+			email := options.Find("email")
+
+			// hashing the email can take longer than discord waits for a
+			// response
+			return deferResponse(s, e, func() string {
+				// lowercase the email, trim whitespace
+				msg, err := Register(s, e.AppID, e.Token, e.Member.User, e.GuildID, strings.TrimSpace(strings.ToLower(email.String())))
+				if err != nil {
+					interactionLog(e).Error("registration error", "err", err)
+					if msg == "" {
+						return errorMessage
+					}
+				}
+				// the result of sending the email is reported by the outbox
+				return msg
+			})
 		},
 	},
 
@@ -108,7 +118,7 @@ var commandsGlobal = []Command{
 
 			msg, err := Verify(s, e.SenderID(), e.GuildID, strings.TrimSpace(token.String()))
 			if err != nil {
-				log.Println("verification error:", err)
+				interactionLog(e).Error("verification error", "err", err)
 				return errorResponse
 			}
 			return makeEphemeralResponse(msg)
@@ -125,54 +135,566 @@ var commandsGlobal = []Command{
 				&discord.UserOption{
 					OptionName:  "user",
 					Description: "The user to be banned",
-					Required:    true,
+				},
+				&discord.StringOption{
+					OptionName:  "email",
+					Description: "An email to ban, even if nobody has verified with it yet",
+				},
+				&discord.AttachmentOption{
+					OptionName:  "file",
+					Description: "A text or CSV file of emails to ban",
+				},
+				&discord.StringOption{
+					OptionName:  "reason",
+					Description: "Why they're being banned, shown in /bans list",
+				},
+				&discord.IntegerOption{
+					OptionName:  "days",
+					Description: "How many days the ban lasts, leave empty to ban forever",
+					Min:         option.NewInt(1),
+					Max:         option.NewInt(maxBanDays),
 				},
 			},
 		},
 		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
-			user, err := options.Find("user").SnowflakeValue()
+			userOpt, emailOpt, fileOpt := options.Find("user"), options.Find("email"), options.Find("file")
+			given := 0
+			for _, opt := range []discord.CommandInteractionOption{userOpt, emailOpt, fileOpt} {
+				if opt.Value != nil {
+					given++
+				}
+			}
+			if given != 1 {
+				return makeEphemeralResponse("Give one of a user, an email or a file of emails to ban.")
+			}
+
+			reason := strings.TrimSpace(options.Find("reason").String())
+			var duration time.Duration
+			if opt := options.Find("days"); opt.Value != nil {
+				days, err := opt.IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing days", "err", err)
+					return errorResponse
+				}
+				duration = time.Duration(days) * 24 * time.Hour
+			}
+
+			var msg string
+			var err error
+			switch {
+			case userOpt.Value != nil:
+				var user discord.Snowflake
+				user, err = userOpt.SnowflakeValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing user", "err", err)
+					return errorResponse
+				}
+				msg, err = Ban(s, e.SenderID(), discord.UserID(user), e.GuildID, reason, duration)
+			case emailOpt.Value != nil:
+				msg, err = BanEmailAddress(s, e.SenderID(), e.GuildID, emailOpt.String(), reason, duration)
+			default:
+				var id discord.Snowflake
+				id, err = fileOpt.SnowflakeValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing attachment", "err", err)
+					return errorResponse
+				}
+				file, ok := e.Data.(*discord.CommandInteraction).Resolved.Attachments[discord.AttachmentID(id)]
+				if !ok {
+					interactionLog(e).Error("attachment wasn't resolved", "attachment", id)
+					return errorResponse
+				}
+				// hashing every email takes longer than discord waits for a
+				// response, so respond now and edit it when the import is done
+				return deferResponse(s, e, func() string {
+					msg, err := BanImport(s, e.SenderID(), e.GuildID, file, reason, duration)
+					if err != nil {
+						interactionLog(e).Error("ban import error", "err", err)
+						return errorMessage
+					}
+					return msg
+				})
+			}
 			if err != nil {
-				log.Println("error parsing user:", err)
+				interactionLog(e).Error("ban error", "err", err)
 				return errorResponse
 			}
+			return makeEphemeralResponse(msg)
+		},
+	},
+
+	{
+		Data: api.CreateCommandData{
+			Name:        "status",
+			Description: "See whether you're verified",
+			Type:        discord.ChatInputCommand,
+		},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			// exit early if in DMs somehow
+			if e.Member == nil {
+				return nil
+			}
 
-			msg, err := Ban(s, discord.UserID(user), e.GuildID)
+			msg, err := Status(s, e.SenderID(), e.GuildID)
 			if err != nil {
-				log.Println("ban error:", err)
+				interactionLog(e).Error("status error", "err", err)
 				return errorResponse
 			}
 			return makeEphemeralResponse(msg)
 		},
 	},
+
 	{
 		Data: api.CreateCommandData{
-			Name:                     "config",
-			Description:              "Configure the verification channel and role",
+			Name:        "unverify",
+			Description: "Unlink your email, or remove someone else's verification without banning them",
+			Type:        discord.ChatInputCommand,
+			Options: []discord.CommandOption{
+				&discord.UserOption{
+					OptionName:  "user",
+					Description: "The user to unverify, needs the Manage Roles permission",
+				},
+			},
+		},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			// exit early if in DMs somehow
+			if e.Member == nil {
+				return nil
+			}
+
+			user := e.SenderID()
+			if opt := options.Find("user"); opt.Value != nil {
+				snowflake, err := opt.SnowflakeValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing user", "err", err)
+					return errorResponse
+				}
+				user = discord.UserID(snowflake)
+			}
+			if user != e.SenderID() && !hasPermission(e, discord.PermissionManageRoles) {
+				return makeEphemeralResponse("Sorry, you need the Manage Roles permission to unverify other people.")
+			}
+
+			msg, err := Unverify(s, e.SenderID(), user, e.GuildID)
+			if err != nil {
+				interactionLog(e).Error("unverify error", "err", err)
+				return errorResponse
+			}
+			return makeEphemeralResponse(msg)
+		},
+	},
+
+	{
+		Data: api.CreateCommandData{
+			Name:                     "lookup",
+			Description:              "Find the account an email was verified by, every lookup is logged",
 			Type:                     discord.ChatInputCommand,
-			DefaultMemberPermissions: ConstRef(discord.PermissionAdministrator),
+			DefaultMemberPermissions: ConstRef(discord.PermissionBanMembers),
 			Options: []discord.CommandOption{
 				&discord.StringOption{
-					OptionName:  "domain",
-					Description: "The domain to filter emails by (for example, gmail.com)",
+					OptionName:  "email",
+					Description: "The email to look up",
 					Required:    true,
 				},
-				&discord.RoleOption{
-					OptionName:  "role",
-					Description: "The role that Gatekeeper gives to verified users",
-					Required:    true,
+			},
+		},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			// the email is hashed under every identifier it may be stored
+			// under, which can take longer than discord waits for a response
+			return deferResponse(s, e, func() string {
+				msg, err := Lookup(s, e.SenderID(), e.GuildID, options.Find("email").String())
+				if err != nil {
+					interactionLog(e).Error("lookup error", "err", err)
+					return errorMessage
+				}
+				return msg
+			})
+		},
+	},
+
+	{
+		Data: api.CreateCommandData{
+			Name:                     "unban",
+			Description:              "Let a banned user's email verify again",
+			Type:                     discord.ChatInputCommand,
+			DefaultMemberPermissions: ConstRef(discord.PermissionBanMembers),
+			Options: []discord.CommandOption{
+				&discord.UserOption{
+					OptionName:  "user",
+					Description: "The user to be unbanned",
+				},
+				&discord.IntegerOption{
+					OptionName:  "id",
+					Description: "The ID of the ban from /bans list",
+					Min:         option.NewInt(1),
 				},
 			},
 		},
 		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
-			domain := options.Find("domain").String()
-			role, err := options.Find("role").SnowflakeValue()
+			userOpt, idOpt := options.Find("user"), options.Find("id")
+			if (userOpt.Value == nil) == (idOpt.Value == nil) {
+				return makeEphemeralResponse("Give either a user or a ban ID to unban.")
+			}
+
+			var msg string
+			if userOpt.Value != nil {
+				user, err := userOpt.SnowflakeValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing user", "err", err)
+					return errorResponse
+				}
+				msg, err = Unban(s, discord.UserID(user), e.GuildID)
+				if err != nil {
+					interactionLog(e).Error("unban error", "err", err)
+					return errorResponse
+				}
+			} else {
+				id, err := idOpt.IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing ban id", "err", err)
+					return errorResponse
+				}
+				msg, err = UnbanID(s, id, e.GuildID)
+				if err != nil {
+					interactionLog(e).Error("unban error", "err", err)
+					return errorResponse
+				}
+			}
+			return makeEphemeralResponse(msg)
+		},
+	},
+
+	{
+		Data: api.CreateCommandData{
+			Name:                     "bans",
+			Description:              "Manage banned emails",
+			Type:                     discord.ChatInputCommand,
+			DefaultMemberPermissions: ConstRef(discord.PermissionBanMembers),
+			Options: []discord.CommandOption{
+				&discord.SubcommandOption{
+					OptionName:  "list",
+					Description: "List the server's bans, newest first",
+					Options: []discord.CommandOptionValue{
+						&discord.IntegerOption{
+							OptionName:  "page",
+							Description: "Which page of bans to show",
+							Min:         option.NewInt(1),
+						},
+					},
+				},
+			},
+		},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			name, options := subcommand(options)
+			if name != "list" {
+				interactionLog(e).Warn("unknown bans subcommand", "subcommand", name)
+				return errorResponse
+			}
+
+			page := int64(1)
+			if opt := options.Find("page"); opt.Value != nil {
+				var err error
+				page, err = opt.IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing page", "err", err)
+					return errorResponse
+				}
+			}
+
+			msg, err := ListBans(s, e.GuildID, int(page))
 			if err != nil {
-				log.Println("error parsing role:", err)
+				interactionLog(e).Error("error listing bans", "err", err)
+				return errorResponse
+			}
+			return makeEphemeralResponse(msg)
+		},
+	},
+	{
+		Data: api.CreateCommandData{
+			Name:                     "config",
+			Description:              "Configure how Gatekeeper verifies users",
+			Type:                     discord.ChatInputCommand,
+			DefaultMemberPermissions: ConstRef(discord.PermissionAdministrator),
+			Options: []discord.CommandOption{
+				&discord.SubcommandGroupOption{
+					OptionName:  "domain",
+					Description: "Configure which email domains can verify",
+					Subcommands: []*discord.SubcommandOption{
+						{
+							OptionName:  "add",
+							Description: "Add an email domain, or change the role it gives",
+							Options: []discord.CommandOptionValue{
+								&discord.StringOption{
+									OptionName:  "domain",
+									Description: "The domain to filter emails by (for example, gmail.com)",
+									Required:    true,
+								},
+								&discord.RoleOption{
+									OptionName:  "role",
+									Description: "The role that Gatekeeper gives to verified users",
+									Required:    true,
+								},
+							},
+						},
+						{
+							OptionName:  "remove",
+							Description: "Stop an email domain from being used to verify",
+							Options: []discord.CommandOptionValue{
+								&discord.StringOption{
+									OptionName:  "domain",
+									Description: "The domain to remove",
+									Required:    true,
+								},
+								&discord.BooleanOption{
+									OptionName:  "cancel-tokens",
+									Description: "Cancel tokens that were emailed for the domain but not used yet",
+								},
+							},
+						},
+						{
+							OptionName:  "mailbox",
+							Description: "Choose which addresses of a domain count as the same inbox",
+							Options: []discord.CommandOptionValue{
+								&discord.StringOption{
+									OptionName:  "domain",
+									Description: "The domain to change",
+									Required:    true,
+								},
+								&discord.StringOption{
+									OptionName:  "tags",
+									Description: "What starts a tag to ignore, like the + in someone+tag@gmail.com",
+									Required:    true,
+									Choices: []discord.StringChoice{
+										{Name: "+", Value: "+"},
+										{Name: "-", Value: "-"},
+										{Name: "+ or -", Value: "+-"},
+										{Name: "nothing", Value: "none"},
+										{Name: "use the built-in rules", Value: "builtin"},
+									},
+								},
+								&discord.BooleanOption{
+									OptionName:  "ignore-dots",
+									Description: "Whether first.last and firstlast are the same inbox",
+								},
+							},
+						},
+						{
+							OptionName:  "list",
+							Description: "List the email domains and the roles they give",
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "show",
+					Description: "Show everything that's configured",
+				},
+				&discord.SubcommandOption{
+					OptionName:  "token-ttl",
+					Description: "Configure how long verification tokens are valid for",
+					Options: []discord.CommandOptionValue{
+						&discord.IntegerOption{
+							OptionName:  "minutes",
+							Description: "How many minutes a token is valid for after it's emailed",
+							Required:    true,
+							Min:         option.NewInt(1),
+							Max:         option.NewInt(24 * 60),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "rate-limit",
+					Description: "Configure how many verification emails /register can send",
+					Options: []discord.CommandOptionValue{
+						&discord.StringOption{
+							OptionName:  "per",
+							Description: "What the emails are counted by",
+							Required:    true,
+							Choices: []discord.StringChoice{
+								{Name: "user", Value: string(RateLimitUser)},
+								{Name: "email address", Value: string(RateLimitEmail)},
+								{Name: "server", Value: string(RateLimitGuild)},
+							},
+						},
+						&discord.IntegerOption{
+							OptionName:  "count",
+							Description: "How many emails can be sent in the window, 0 for no limit",
+							Required:    true,
+							Min:         option.NewInt(0),
+							Max:         option.NewInt(10000),
+						},
+						&discord.IntegerOption{
+							OptionName:  "minutes",
+							Description: "How long the window is, in minutes",
+							Required:    true,
+							Min:         option.NewInt(1),
+							Max:         option.NewInt(int(maxRateLimitWindow / time.Minute)),
+						},
+					},
+				},
+				&discord.SubcommandGroupOption{
+					OptionName:  "template",
+					Description: "Customize the verification email",
+					Subcommands: []*discord.SubcommandOption{
+						{
+							OptionName:  "set",
+							Description: "Change parts of the verification email, the rest stay the same",
+							Options: []discord.CommandOptionValue{
+								&discord.StringOption{
+									OptionName:  "subject",
+									Description: "Template for the subject, like {{.GuildName}} verification",
+								},
+								&discord.StringOption{
+									OptionName:  "intro",
+									Description: "Text to introduce the email with",
+								},
+								&discord.StringOption{
+									OptionName:  "support",
+									Description: "Who users should contact for help",
+								},
+								&discord.StringOption{
+									OptionName:  "text",
+									Description: "Template for the plain text email, uses {{.Token}}, {{.GuildName}}, {{.Expiry}}, {{.Requester}}",
+								},
+								&discord.StringOption{
+									OptionName:  "html",
+									Description: "Template for the HTML email, uses {{.Token}}, {{.GuildName}}, {{.Expiry}}, {{.Requester}}",
+								},
+							},
+						},
+						{
+							OptionName:  "preview",
+							Description: "Show what the verification email looks like",
+						},
+						{
+							OptionName:  "reset",
+							Description: "Go back to the default verification email",
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "mod-log",
+					Description: "Configure where Gatekeeper reports things moderators should know about",
+					Options: []discord.CommandOptionValue{
+						&discord.ChannelOption{
+							OptionName:   "channel",
+							Description:  "The channel to report to, leave empty to disable the mod log",
+							ChannelTypes: []discord.ChannelType{discord.GuildText},
+						},
+					},
+				},
+			},
+		},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			var msg string
+			var err error
+
+			name, options := subcommand(options)
+			switch name {
+			case "domain":
+				name, options := subcommand(options)
+				switch name {
+				case "add":
+					var role discord.Snowflake
+					domain := options.Find("domain").String()
+					role, err = options.Find("role").SnowflakeValue()
+					if err != nil {
+						interactionLog(e).Error("error parsing role", "err", err)
+						return errorResponse
+					}
+					msg, err = ConfigDomainAdd(s, e.GuildID, domain, discord.RoleID(role))
+				case "remove":
+					cancelTokens := false
+					if opt := options.Find("cancel-tokens"); opt.Value != nil {
+						cancelTokens, err = opt.BoolValue()
+						if err != nil {
+							interactionLog(e).Error("error parsing cancel-tokens", "err", err)
+							return errorResponse
+						}
+					}
+					msg, err = ConfigDomainRemove(s, e.GuildID, options.Find("domain").String(), cancelTokens)
+				case "mailbox":
+					var rules *MailboxRules
+					if tags := options.Find("tags").String(); tags != "builtin" {
+						rules = &MailboxRules{}
+						if tags != "none" {
+							rules.TagSeparators = tags
+						}
+						if opt := options.Find("ignore-dots"); opt.Value != nil {
+							rules.IgnoreDots, err = opt.BoolValue()
+							if err != nil {
+								interactionLog(e).Error("error parsing ignore-dots", "err", err)
+								return errorResponse
+							}
+						}
+					}
+					msg, err = ConfigDomainMailbox(s, e.GuildID, options.Find("domain").String(), rules)
+				case "list":
+					msg, err = ConfigDomainList(s, e.GuildID)
+				default:
+					interactionLog(e).Warn("unknown config domain subcommand", "subcommand", name)
+					return errorResponse
+				}
+			case "show":
+				msg, err = ConfigShow(s, e.GuildID)
+			case "token-ttl":
+				var minutes int64
+				minutes, err = options.Find("minutes").IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing minutes", "err", err)
+					return errorResponse
+				}
+				msg, err = ConfigTokenTTL(s, e.GuildID, time.Duration(minutes)*time.Minute)
+			case "rate-limit":
+				var count, minutes int64
+				scope := RateLimitScope(options.Find("per").String())
+				count, err = options.Find("count").IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing count", "err", err)
+					return errorResponse
+				}
+				minutes, err = options.Find("minutes").IntValue()
+				if err != nil {
+					interactionLog(e).Error("error parsing minutes", "err", err)
+					return errorResponse
+				}
+				limit := RateLimit{Count: int(count), Window: time.Duration(minutes) * time.Minute}
+				msg, err = ConfigRateLimit(s, e.GuildID, scope, limit)
+			case "template":
+				name, options := subcommand(options)
+				switch name {
+				case "set":
+					msg, err = ConfigTemplate(s, e.GuildID, *e.Sender(),
+						optionalString(options, "subject"),
+						optionalString(options, "intro"),
+						optionalString(options, "support"),
+						optionalString(options, "text"),
+						optionalString(options, "html"))
+				case "preview":
+					msg, err = ConfigTemplatePreview(s, e.GuildID, *e.Sender())
+				case "reset":
+					msg, err = ConfigTemplateReset(s, e.GuildID)
+				default:
+					interactionLog(e).Warn("unknown config template subcommand", "subcommand", name)
+					return errorResponse
+				}
+			case "mod-log":
+				channel := discord.NullChannelID
+				if opt := options.Find("channel"); opt.Value != nil {
+					var snowflake discord.Snowflake
+					snowflake, err = opt.SnowflakeValue()
+					if err != nil {
+						interactionLog(e).Error("error parsing channel", "err", err)
+						return errorResponse
+					}
+					channel = discord.ChannelID(snowflake)
+				}
+				msg, err = ConfigModLog(s, e.GuildID, channel)
+			default:
+				interactionLog(e).Warn("unknown config subcommand", "subcommand", name)
 				return errorResponse
 			}
-			msg, err := Config(s, e.GuildID, domain, discord.RoleID(role))
 			if err != nil {
-				log.Println("ban error:", err)
+				interactionLog(e).Error("config error", "err", err)
 				return errorResponse
 			}
 			return makeEphemeralResponse(msg)
@@ -193,7 +715,9 @@ var commandsGlobal = []Command{
 	// },
 }
 
-var errorResponse = makeEphemeralResponse("Sorry, an error has occurred")
+const errorMessage = "Sorry, an error has occurred"
+
+var errorResponse = makeEphemeralResponse(errorMessage)
 
 func makeEphemeralResponse(msg string) *api.InteractionResponse {
 	return &api.InteractionResponse{
@@ -205,17 +729,120 @@ func makeEphemeralResponse(msg string) *api.InteractionResponse {
 	}
 }
 
+// subcommand returns the name and options of the subcommand (or subcommand
+// group) that was used. Call it again on the options of a group to get the
+// subcommand inside of it.
+func subcommand(options discord.CommandInteractionOptions) (string, discord.CommandInteractionOptions) {
+	if len(options) == 0 {
+		return "", nil
+	}
+	return options[0].Name, options[0].Options
+}
+
+// optionalString returns nil if the option wasn't given.
+func optionalString(options discord.CommandInteractionOptions, name string) *string {
+	opt := options.Find(name)
+	if opt.Value == nil {
+		return nil
+	}
+	value := opt.String()
+	return &value
+}
+
 func sentByOwner(s *state.State, e *gateway.InteractionCreateEvent) bool {
 	thisGuild, err := s.Guild(e.GuildID)
 	if err != nil {
-		log.Println("wtf! guild", e.GuildID, "doesn't exist")
+		interactionLog(e).Error("guild doesn't exist")
 		return false
 	}
 
 	return thisGuild.OwnerID == e.SenderID()
 }
 
-func MakeCommandHandlers(s *state.State, commands []Command) func(*gateway.InteractionCreateEvent) {
+// memberPermissions holds the sender's permissions that discord sends with
+// each interaction, by interaction ID. arikawa doesn't decode them, so they're
+// picked out of the payload by rememberPermissions and forgotten once the
+// interaction has been handled.
+var memberPermissions sync.Map
+
+// interactionPermissions is the part of an interaction payload that arikawa
+// leaves out.
+type interactionPermissions struct {
+	ID     discord.InteractionID `json:"id"`
+	Member *struct {
+		Permissions discord.Permissions `json:"permissions,string"`
+	} `json:"member"`
+}
+
+// rememberPermissions keeps the sender's permissions from a raw interaction
+// for hasPermission. Interactions from DMs don't have any.
+func rememberPermissions(payload []byte) error {
+	var i interactionPermissions
+	if err := json.Unmarshal(payload, &i); err != nil {
+		return fmt.Errorf("error decoding interaction permissions: %w", err)
+	}
+	if i.Member != nil {
+		memberPermissions.Store(i.ID, i.Member.Permissions)
+	}
+	return nil
+}
+
+// hasPermission checks whether whoever sent the interaction has perm in the
+// channel it was sent from, going by what discord sent with the interaction
+// so that it works without the gateway's cache.
+func hasPermission(e *gateway.InteractionCreateEvent, perm discord.Permissions) bool {
+	perms, ok := memberPermissions.Load(e.ID)
+	if !ok {
+		interactionLog(e).Error("interaction has no permissions")
+		return false
+	}
+	return perms.(discord.Permissions).Has(perm)
+}
+
+// gatewayInteraction decodes interactions from the gateway like arikawa does,
+// also remembering the sender's permissions.
+type gatewayInteraction struct {
+	gateway.InteractionCreateEvent
+}
+
+func (e *gatewayInteraction) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.InteractionCreateEvent); err != nil {
+		return err
+	}
+	return rememberPermissions(b)
+}
+
+func init() {
+	// replaces arikawa's own INTERACTION_CREATE event
+	gateway.OpUnmarshalers.Add(func() ws.Event { return new(gatewayInteraction) })
+}
+
+func MakeCommandHandlers(s *state.State, commands []Command) func(*gatewayInteraction) {
+	handle := makeInteractionHandler(s, commands)
+
+	return func(gi *gatewayInteraction) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+
+		e := &gi.InteractionCreateEvent
+		data := handle(e)
+		if data == nil {
+			// no response
+			responded(e.ID, false)
+			return
+		}
+
+		err := s.RespondInteraction(e.ID, e.Token, *data)
+		if err != nil {
+			interactionLog(e).Error("failed to send interaction callback", "err", err)
+		}
+		responded(e.ID, err == nil)
+	}
+}
+
+// makeInteractionHandler returns the response to an interaction, whether it
+// came from the gateway or over HTTP.
+func makeInteractionHandler(s *state.State, commands []Command) func(*gateway.InteractionCreateEvent) *api.InteractionResponse {
 	handlers := make(map[string]CommandHandler, len(commands))
 
 	handlers["ping"] = pingHandler
@@ -224,15 +851,14 @@ func MakeCommandHandlers(s *state.State, commands []Command) func(*gateway.Inter
 		handlers[c.Data.Name] = c.Handler
 	}
 
-	return func(e *gateway.InteractionCreateEvent) {
+	return func(e *gateway.InteractionCreateEvent) *api.InteractionResponse {
+		defer memberPermissions.Delete(e.ID)
+
 		switch i := e.Data.(type) {
 		case *discord.PingInteraction:
-			data := api.InteractionResponse{
+			return &api.InteractionResponse{
 				Type: api.PongInteraction,
 			}
-			if err := s.RespondInteraction(e.ID, e.Token, data); err != nil {
-				log.Println("failed to send interaction callback:", err)
-			}
 		case *discord.CommandInteraction:
 			cmd := i
 			name := cmd.Name
@@ -240,21 +866,77 @@ func MakeCommandHandlers(s *state.State, commands []Command) func(*gateway.Inter
 
 			handler, ok := handlers[name]
 			if !ok {
-				log.Println("Unrecognised command:", name)
-				return
+				interactionLog(e).Warn("unrecognised command")
+				return nil
 			}
 
+			start := time.Now()
 			data := handler(s, e, options)
-			if data == nil {
-				// no response
-				return
-			}
-
-			if err := s.RespondInteraction(e.ID, e.Token, *data); err != nil {
-				log.Println("failed to send interaction callback:", err)
-			}
+			commandDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			interactionLog(e).Info("handled command", latency(start))
+			return data
 		default:
-			log.Printf("Unknown interaction of type %T\n", i)
+			interactionLog(e).Warn("unknown interaction", "type", fmt.Sprintf("%T", i))
+			return nil
+		}
+	}
+}
+
+// afterResponse holds work that's waiting for an interaction to be responded
+// to, by interaction ID.
+var afterResponse sync.Map
+
+// inFlight counts interactions from the gateway and deferred work that are
+// still being handled, so that shutdown can wait for them before the db is
+// closed. The interaction server waits for its own requests.
+var inFlight sync.WaitGroup
+
+// waitInFlight waits for everything counted by inFlight to finish, or for ctx
+// to be done.
+func waitInFlight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deferResponse tells discord that a response is coming, and once that's been
+// sent, runs work and edits the response to what it returns. This is for
+// commands that take longer than discord waits for a response. work can
+// return "" to leave the response for something else to edit.
+func deferResponse(s *state.State, e *gateway.InteractionCreateEvent, work func() string) *api.InteractionResponse {
+	afterResponse.Store(e.ID, func() {
+		msg := work()
+		if msg == "" {
+			return
 		}
+		data := api.EditInteractionResponseData{Content: option.NewNullableString(msg)}
+		if _, err := s.EditInteractionResponse(e.AppID, e.Token, data); err != nil {
+			interactionLog(e).Error("error editing interaction response", "err", err)
+		}
+	})
+	return &api.InteractionResponse{
+		Type: api.DeferredMessageInteractionWithSource,
+		Data: &api.InteractionResponseData{Flags: api.EphemeralResponse},
+	}
+}
+
+// responded starts any work that was waiting for the interaction to be
+// responded to, or drops it if the response couldn't be sent.
+func responded(id discord.InteractionID, ok bool) {
+	work, found := afterResponse.LoadAndDelete(id)
+	if found && ok {
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			work.(func())()
+		}()
 	}
 }
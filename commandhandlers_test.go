@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/httputil/httpdriver"
+)
+
+// discord rejects the whole batch of commands if any of them break its limits
+// https://discord.com/developers/docs/interactions/application-commands#application-command-object
+func TestCommandDefinitions(t *testing.T) {
+	validName := regexp.MustCompile(`^[-_\p{L}\p{N}]{1,32}$`)
+
+	var checkOptions func(path string, options []discord.CommandOption)
+	check := func(path, name, description string) {
+		if !validName.MatchString(name) || name != strings.ToLower(name) {
+			t.Errorf("%s: invalid name %q", path, name)
+		}
+		if len(description) < 1 || len([]rune(description)) > 100 {
+			t.Errorf("%s: description should be 1-100 characters, got %v", path, len([]rune(description)))
+		}
+	}
+	checkOptions = func(path string, options []discord.CommandOption) {
+		if len(options) > 25 {
+			t.Errorf("%s: too many options", path)
+		}
+		for _, option := range options {
+			optionPath := path + " " + option.Name()
+			switch option := option.(type) {
+			case *discord.SubcommandGroupOption:
+				check(optionPath, option.OptionName, option.Description)
+				subcommands := make([]discord.CommandOption, len(option.Subcommands))
+				for i, subcommand := range option.Subcommands {
+					subcommands[i] = subcommand
+				}
+				checkOptions(optionPath, subcommands)
+			case *discord.SubcommandOption:
+				check(optionPath, option.OptionName, option.Description)
+				values := make([]discord.CommandOption, len(option.Options))
+				for i, value := range option.Options {
+					values[i] = value
+				}
+				checkOptions(optionPath, values)
+			default:
+				check(optionPath, option.Name(), optionDescription(option))
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	for _, command := range commandsGlobal {
+		if names[command.Data.Name] {
+			t.Errorf("duplicate command %s", command.Data.Name)
+		}
+		names[command.Data.Name] = true
+		check("/"+command.Data.Name, command.Data.Name, command.Data.Description)
+		checkOptions("/"+command.Data.Name, command.Data.Options)
+	}
+}
+
+func optionDescription(option discord.CommandOption) string {
+	switch option := option.(type) {
+	case *discord.StringOption:
+		return option.Description
+	case *discord.IntegerOption:
+		return option.Description
+	case *discord.BooleanOption:
+		return option.Description
+	case *discord.UserOption:
+		return option.Description
+	case *discord.ChannelOption:
+		return option.Description
+	case *discord.RoleOption:
+		return option.Description
+	case *discord.MentionableOption:
+		return option.Description
+	case *discord.NumberOption:
+		return option.Description
+	case *discord.AttachmentOption:
+		return option.Description
+	default:
+		return ""
+	}
+}
+
+// handlerTransport answers requests with a handler instead of the network.
+type handlerTransport http.HandlerFunc
+
+func (h handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	return rec.Result(), nil
+}
+
+// fakeDiscord records the requests the bot makes to discord, and answers them
+// all with 204 No Content.
+type fakeDiscord struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeDiscord) state() *state.State {
+	s := state.New("Bot token")
+	s.Client.Client.Client = httpdriver.WrapClient(http.Client{
+		Transport: handlerTransport(func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+			f.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	})
+	return s
+}
+
+func (f *fakeDiscord) requested(method, path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" ") && strings.HasSuffix(r, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandInteraction decodes an interaction payload the way the gateway and
+// the interaction server do.
+func commandInteraction(t *testing.T, payload string) *gateway.InteractionCreateEvent {
+	t.Helper()
+	var e gateway.InteractionCreateEvent
+	if err := json.Unmarshal([]byte(payload), &e.InteractionEvent); err != nil {
+		t.Fatal(err)
+	}
+	if err := rememberPermissions([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return &e
+}
+
+func unverifyInteraction(t *testing.T, sender, user discord.UserID, perms discord.Permissions) *gateway.InteractionCreateEvent {
+	options := "[]"
+	if user.IsValid() {
+		options = fmt.Sprintf(`[{"type": 6, "name": "user", "value": "%v"}]`, user)
+	}
+	return commandInteraction(t, fmt.Sprintf(`{
+		"id": "100", "application_id": "1", "type": 2, "token": "token", "version": 1,
+		"guild_id": "10", "channel_id": "11",
+		"member": {"user": {"id": "%v"}, "roles": [], "permissions": "%d"},
+		"data": {"id": "101", "type": 1, "name": "unverify", "options": %s}
+	}`, sender, perms, options))
+}
+
+func responseContent(t *testing.T, res *api.InteractionResponse) string {
+	t.Helper()
+	if res == nil || res.Data == nil {
+		t.Fatalf("expected a message, got %+v", res)
+	}
+	return res.Data.Content.Val
+}
+
+func TestUnverify(t *testing.T) {
+	oldDB := db
+	defer func() { db = oldDB }()
+
+	const guild = discord.GuildID(10)
+	const role = discord.RoleID(20)
+	const member = discord.UserID(2)
+	const moderator = discord.UserID(3)
+	roleRemoval := fmt.Sprintf("/guilds/%v/members/%v/roles/%v", guild, member, role)
+
+	setup := func(t *testing.T) (*fakeDiscord, func(*gateway.InteractionCreateEvent) *api.InteractionResponse) {
+		store := newTestStore(t)
+		db = store
+		err := store.SetVerifiedEmail(guild, Identifier{1}, member, role, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := &fakeDiscord{}
+		return fake, makeInteractionHandler(fake.state(), commandsGlobal)
+	}
+	assertVerified := func(t *testing.T, expected bool) {
+		t.Helper()
+		ids, err := db.GetUserIdentifiers(guild, member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verified := len(ids) > 0; verified != expected {
+			t.Errorf("expected verified to be %v, got %v", expected, verified)
+		}
+	}
+
+	t.Run("self", func(t *testing.T) {
+		fake, handle := setup(t)
+		msg := responseContent(t, handle(unverifyInteraction(t, member, 0, 0)))
+		if !strings.Contains(msg, "unlinked") {
+			t.Errorf("unexpected response %q", msg)
+		}
+		if !fake.requested(http.MethodDelete, roleRemoval) {
+			t.Errorf("expected the verified role to be removed, got requests %v", fake.requests)
+		}
+		assertVerified(t, false)
+	})
+
+	t.Run("moderator", func(t *testing.T) {
+		fake, handle := setup(t)
+		msg := responseContent(t, handle(unverifyInteraction(t, moderator, member, discord.PermissionManageRoles)))
+		if !strings.Contains(msg, "no longer verified") {
+			t.Errorf("unexpected response %q", msg)
+		}
+		if !fake.requested(http.MethodDelete, roleRemoval) {
+			t.Errorf("expected the verified role to be removed, got requests %v", fake.requests)
+		}
+		assertVerified(t, false)
+	})
+
+	t.Run("not a moderator", func(t *testing.T) {
+		fake, handle := setup(t)
+		msg := responseContent(t, handle(unverifyInteraction(t, moderator, member, discord.PermissionSendMessages)))
+		if !strings.Contains(msg, "Manage Roles") {
+			t.Errorf("unexpected response %q", msg)
+		}
+		if len(fake.requests) > 0 {
+			t.Errorf("expected no requests to discord, got %v", fake.requests)
+		}
+		assertVerified(t, true)
+	})
+}
+
+func TestGatewayInteractionPermissions(t *testing.T) {
+	decode := gateway.OpUnmarshalers.Lookup(0, "INTERACTION_CREATE")
+	if decode == nil {
+		t.Fatal("no unmarshaler for interactions")
+	}
+	ev := decode()
+	payload := `{"id": "200", "type": 2, "guild_id": "10", "member": {"user": {"id": "2"}, "permissions": "268435456"},
+		"data": {"id": "201", "type": 1, "name": "unverify"}}`
+	if err := json.Unmarshal([]byte(payload), ev); err != nil {
+		t.Fatal(err)
+	}
+	gi, ok := ev.(*gatewayInteraction)
+	if !ok {
+		t.Fatalf("expected interactions to be decoded as %T, got %T", gi, ev)
+	}
+	if gi.SenderID() != 2 {
+		t.Errorf("expected the sender to be decoded, got %v", gi.SenderID())
+	}
+	if !hasPermission(&gi.InteractionCreateEvent, discord.PermissionManageRoles) {
+		t.Error("expected the sender to have Manage Roles")
+	}
+	memberPermissions.Delete(gi.ID)
+}
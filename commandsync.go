@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+// CommandChanges is what registering commands changed, by command name.
+type CommandChanges struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+func (c CommandChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Removed) == 0
+}
+
+func (c CommandChanges) String() string {
+	var parts []string
+	if len(c.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(c.Added, ", "))
+	}
+	if len(c.Updated) > 0 {
+		parts = append(parts, "updated "+strings.Join(c.Updated, ", "))
+	}
+	if len(c.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(c.Removed, ", "))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// commandKeys are the fields of a command that we define. Discord adds others
+// like IDs and versions, which don't count as changes.
+var commandKeys = []string{
+	"type",
+	"name",
+	"name_localizations",
+	"description",
+	"description_localizations",
+	"options",
+	"default_member_permissions",
+}
+
+// normalizeCommand decodes the parts of a command in commandKeys so that what
+// we define can be compared with what discord reports. The commands are
+// compared as JSON rather than arikawa's types, since those can't decode every
+// kind of option.
+func normalizeCommand(raw []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	cmd := make(map[string]interface{}, len(commandKeys))
+	for _, key := range commandKeys {
+		if v, ok := fields[key]; ok {
+			cmd[key] = pruneDefaults(v)
+		}
+	}
+	for key, v := range cmd {
+		if isDefault(v) {
+			delete(cmd, key)
+		}
+	}
+	// discord defaults the type to chat input
+	if _, ok := cmd["type"]; !ok {
+		cmd["type"] = float64(discord.ChatInputCommand)
+	}
+	return cmd, nil
+}
+
+// pruneDefaults removes values that discord leaves out when they're the
+// default, like false and empty lists, so they compare the same either way.
+func pruneDefaults(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, e := range v {
+			e = pruneDefaults(e)
+			if isDefault(e) {
+				delete(v, key)
+			} else {
+				v[key] = e
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = pruneDefaults(e)
+		}
+	}
+	return v
+}
+
+func isDefault(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+// diffCommands works out what registering want would change, given the
+// commands discord already has as JSON.
+func diffCommands(want []api.CreateCommandData, have []json.RawMessage) (CommandChanges, error) {
+	var changes CommandChanges
+
+	registered := make(map[string]map[string]interface{}, len(have))
+	var names []string
+	for _, raw := range have {
+		cmd, err := normalizeCommand(raw)
+		if err != nil {
+			return CommandChanges{}, fmt.Errorf("error decoding registered command: %w", err)
+		}
+		name, _ := cmd["name"].(string)
+		registered[name] = cmd
+		names = append(names, name)
+	}
+
+	wanted := make(map[string]bool, len(want))
+	for _, c := range want {
+		wanted[c.Name] = true
+		old, ok := registered[c.Name]
+		if !ok {
+			changes.Added = append(changes.Added, c.Name)
+			continue
+		}
+		raw, err := json.Marshal(c)
+		if err != nil {
+			return CommandChanges{}, fmt.Errorf("error encoding command %v: %w", c.Name, err)
+		}
+		cmd, err := normalizeCommand(raw)
+		if err != nil {
+			return CommandChanges{}, fmt.Errorf("error decoding command %v: %w", c.Name, err)
+		}
+		if !reflect.DeepEqual(cmd, old) {
+			changes.Updated = append(changes.Updated, c.Name)
+		}
+	}
+
+	for _, name := range names {
+		if !wanted[name] {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+
+	return changes, nil
+}
+
+// SyncCommands makes the commands registered with discord match commands,
+// overwriting them all at once if anything changed. Commands are registered
+// globally if guild isn't valid.
+func SyncCommands(s *state.State, appID discord.AppID, guild discord.GuildID, commands []Command) (CommandChanges, error) {
+	want := make([]api.CreateCommandData, 0, len(commands))
+	for _, c := range commands {
+		want = append(want, c.Data)
+	}
+
+	endpoint := api.EndpointApplications + appID.String() + "/commands"
+	if guild.IsValid() {
+		endpoint = api.EndpointApplications + appID.String() + "/guilds/" + guild.String() + "/commands"
+	}
+	var have []json.RawMessage
+	if err := s.RequestJSON(&have, "GET", endpoint); err != nil {
+		return CommandChanges{}, fmt.Errorf("error getting commands: %w", err)
+	}
+
+	changes, err := diffCommands(want, have)
+	if err != nil {
+		return CommandChanges{}, err
+	}
+	if changes.Empty() {
+		return changes, nil
+	}
+
+	if guild.IsValid() {
+		_, err = s.BulkOverwriteGuildCommands(appID, guild, want)
+	} else {
+		_, err = s.BulkOverwriteCommands(appID, want)
+	}
+	if err != nil {
+		return CommandChanges{}, fmt.Errorf("error overwriting commands: %w", err)
+	}
+	return changes, nil
+}
+
+// syncAndLog syncs commands and logs what changed.
+func syncAndLog(s *state.State, appID discord.AppID, guild discord.GuildID, commands []Command) {
+	logger := slog.With("scope", "global")
+	if guild.IsValid() {
+		logger = slog.With("scope", "guild", "guild", guild)
+	}
+	changes, err := SyncCommands(s, appID, guild, commands)
+	if err != nil {
+		logger.Error("error syncing commands", "err", err)
+		return
+	}
+	if changes.Empty() {
+		logger.Info("commands are up to date")
+		return
+	}
+	logger.Info("synced commands", "changes", changes.String(),
+		"added", changes.Added, "updated", changes.Updated, "removed", changes.Removed)
+}
+
+// globalCommandsFromEnv reads whether commands are registered globally or in
+// each guild from $COMMAND_SCOPE. Global commands can take up to an hour to
+// show up, while guild commands show up straight away.
+func globalCommandsFromEnv() (bool, error) {
+	switch scope := envOr("COMMAND_SCOPE", "guild"); scope {
+	case "guild":
+		return false, nil
+	case "global":
+		return true, nil
+	default:
+		return false, fmt.Errorf("$COMMAND_SCOPE should be guild or global, got %q", scope)
+	}
+}
+
+// guildIDs lists every guild the bot is in.
+func guildIDs(s *state.State) ([]discord.GuildID, error) {
+	guilds, err := s.Client.Guilds(0)
+	if err != nil {
+		return nil, fmt.Errorf("error getting guilds: %w", err)
+	}
+	ids := make([]discord.GuildID, len(guilds))
+	for i, guild := range guilds {
+		ids[i] = guild.ID
+	}
+	return ids, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/api"
+)
+
+func TestDiffCommands(t *testing.T) {
+	want := make([]api.CreateCommandData, len(commandsGlobal))
+	var have []json.RawMessage
+	for i, c := range commandsGlobal {
+		want[i] = c.Data
+		b, err := json.Marshal(c.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, b)
+	}
+
+	changes, err := diffCommands(want, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Empty() {
+		t.Errorf("expected no changes for the same commands, got %v", changes)
+	}
+
+	changes, err = diffCommands(want, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Added) != len(want) || len(changes.Updated) != 0 || len(changes.Removed) != 0 {
+		t.Errorf("expected every command to be added, got %v", changes)
+	}
+
+	// discord fills in IDs and leaves out defaults
+	echo := `{"id":"1","application_id":"2","version":"3","guild_id":"4","type":1,"name":"echo",` +
+		`"description":"Just like Unix","default_member_permissions":null,"dm_permission":true,"nsfw":false,` +
+		`"options":[{"type":3,"name":"message","description":"Echo me!","required":true}]}`
+	changes, err = diffCommands(want[:1], []json.RawMessage{json.RawMessage(echo)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Empty() {
+		t.Errorf("expected no changes for echo as discord reports it, got %v", changes)
+	}
+
+	old := []json.RawMessage{
+		json.RawMessage(`{"id":"1","name":"echo","description":"An old description"}`),
+		json.RawMessage(`{"id":"2","name":"gone","description":"A command that was removed"}`),
+	}
+	changes, err = diffCommands(want[:2], old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CommandChanges{
+		Added:   []string{want[1].Name},
+		Updated: []string{"echo"},
+		Removed: []string{"gone"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+	if s := changes.String(); s != "added "+want[1].Name+"; updated echo; removed gone" {
+		t.Errorf("unexpected summary %q", s)
+	}
+}
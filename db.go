@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"database/sql/driver"
 	"encoding"
 	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/diamondburned/arikawa/v3/discord"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // DONE move each function to SQLite
@@ -65,72 +68,241 @@ func (s DBSnowflake) Value() (driver.Value, error) {
 	return *(*int64)(unsafe.Pointer(&s)), nil
 }
 
-var db DB
+// DBTime is stored as seconds since the unix epoch, since SQLite and Postgres
+// don't agree on date types. The zero time is stored as NULL.
+type DBTime time.Time
 
-type DB struct {
-	db *sql.DB
+var _ sql.Scanner = (*DBTime)(nil)
+
+func (t *DBTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = DBTime{}
+	case int64:
+		*t = DBTime(time.Unix(v, 0))
+	default:
+		return errors.New("expected int64 type")
+	}
+	return nil
 }
 
-func InitDB() (DB, error) {
-	// no need for _loc=auto, since we should use discord time things
-	// https://discord.com/developers/docs/reference#message-formatting
-	// TODO move db name to envvar
-	dbConn, err := sql.Open("sqlite3", "db.sqlite")
-	if err != nil {
-		return DB{}, fmt.Errorf("error opening db: %w", err)
+var _ driver.Valuer = DBTime{}
+
+func (t DBTime) Value() (driver.Value, error) {
+	if time.Time(t).IsZero() {
+		return nil, nil
 	}
-	err = dbConn.Ping()
-	if err != nil {
-		return DB{}, fmt.Errorf("failed to establish connection to DB")
+	return time.Time(t).Unix(), nil
+}
+
+// DBIdentifiers stores a list of identifiers in one column, as hex separated
+// by spaces. An empty list is stored as null.
+type DBIdentifiers []Identifier
+
+var _ sql.Scanner = &DBIdentifiers{}
+
+func (l *DBIdentifiers) Scan(src any) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return errors.New("expected string type")
+	}
+	var ids DBIdentifiers
+	for _, field := range strings.Fields(text) {
+		b, err := hex.DecodeString(field)
+		if err != nil {
+			return err
+		}
+		var id Identifier
+		if _, err := id.Write(b); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	*l = ids
+	return nil
+}
+
+var _ driver.Valuer = DBIdentifiers{}
+
+func (l DBIdentifiers) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
 	}
-	return DB{db: dbConn}, nil
+	fields := make([]string, len(l))
+	for i, id := range l {
+		fields[i] = hex.EncodeToString(id.Bytes())
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// sqlStore holds the queries of every database/sql backed Store. The SQL
+// sticks to the subset understood by both SQLite and Postgres, so backends
+// only differ in how they're opened and migrated.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func (d *sqlStore) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database can still be reached.
+func (d *sqlStore) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
 }
 
-// NOTE: positional arguments like $1, $2 ignore the number, so "$2, $1" behaves
-// the same as "$1, $2". I think this is SQLite behaviour, but keep it for
-// Postgres compatibility
+// NOTE: positional arguments like $1, $2 ignore the number in SQLite, so
+// "$2, $1" behaves the same as "$1, $2". Postgres does respect the number, so
+// always write the arguments in the order they're passed.
+
+// NOTE: "user" is a reserved word in Postgres, so it always has to be quoted.
+
+var ErrTokenExpired = errors.New("token has expired")
+
+// EmailToken is a pending verification, waiting for User to prove they own the
+// email behind Identifier.
+type EmailToken struct {
+	Identifier Identifier
+	User       discord.UserID
+	Role       discord.RoleID
+	Domain     string
+	// Previous are the other identifiers the email may already be stored
+	// under, which are rehashed to Identifier once it's verified
+	Previous []Identifier
+}
 
-func (d *DB) GetEmailToken(guild discord.GuildID, token Token) (Identifier, discord.RoleID, bool, error) {
+// GetEmailToken returns ErrTokenExpired if the token exists but can no longer
+// be used.
+func (d *sqlStore) GetEmailToken(guild discord.GuildID, token Token) (EmailToken, bool, error) {
 	s := `
-		SELECT identifier, verification_role FROM token 
+		SELECT identifier, previous_identifiers, token."user", verification_role, token.email_domain, expires_at FROM token
 		INNER JOIN config ON token.guild = config.guild AND token.email_domain = config.email_domain
 		WHERE token = $1 AND token.guild = $2
 	`
 	row := d.db.QueryRow(s, token[:], DBSnowflake(guild))
 
 	var idBuf []byte
-	var snowflake DBSnowflake
-	err := row.Scan(&idBuf, &snowflake)
+	var previous DBIdentifiers
+	var user, role DBSnowflake
+	var domain string
+	var expiresAt DBTime
+	err := row.Scan(&idBuf, &previous, &user, &role, &domain, &expiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
-		return Identifier{}, discord.NullRoleID, false, nil
+		return EmailToken{}, false, nil
 	}
 	if err != nil {
-		return Identifier{}, discord.NullRoleID, false, err
+		return EmailToken{}, false, err
+	}
+	if !time.Now().Before(time.Time(expiresAt)) {
+		return EmailToken{}, false, ErrTokenExpired
 	}
 
 	var id Identifier
 	_, err = id.Write(idBuf)
 	if err != nil {
-		return Identifier{}, discord.NullRoleID, false, err
+		return EmailToken{}, false, err
+	}
+	return EmailToken{
+		Identifier: id,
+		User:       discord.UserID(user),
+		Role:       discord.RoleID(role),
+		Domain:     domain,
+		Previous:   previous,
+	}, true, nil
+}
+
+// PendingTokenExpiry returns when the user's newest unexpired token expires.
+func (d *sqlStore) PendingTokenExpiry(guild discord.GuildID, user discord.UserID) (time.Time, bool, error) {
+	s := `SELECT MAX(expires_at) FROM token WHERE guild = $1 AND "user" = $2 AND expires_at > $3`
+	row := d.db.QueryRow(s, DBSnowflake(guild), DBSnowflake(user), DBTime(time.Now()))
+	var expiresAt DBTime
+	err := row.Scan(&expiresAt)
+	if err != nil {
+		return time.Time{}, false, err
 	}
-	return id, discord.RoleID(snowflake), true, nil
+	return time.Time(expiresAt), !time.Time(expiresAt).IsZero(), nil
 }
 
-func (d *DB) SetEmailToken(guild discord.GuildID, id Identifier, token Token, domain string) error {
-	s := "INSERT INTO token (guild, token, identifier, email_domain) VALUES ($1,$2,$3,$4)"
-	_, err := d.db.Exec(s, guild, token[:], id[:], domain)
+// PendingTokenCounts counts the unexpired tokens in each guild.
+func (d *sqlStore) PendingTokenCounts() (map[discord.GuildID]int, error) {
+	s := "SELECT guild, COUNT(*) FROM token WHERE expires_at > $1 GROUP BY guild"
+	return d.guildCounts(s, DBTime(time.Now()))
+}
+
+func (d *sqlStore) SetEmailToken(guild discord.GuildID, user discord.UserID, id Identifier, previous []Identifier, token Token, domain string, expiresAt time.Time) error {
+	s := `INSERT INTO token (guild, "user", token, identifier, previous_identifiers, email_domain, expires_at) VALUES ($1,$2,$3,$4,$5,$6,$7)`
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(user), token[:], id, DBIdentifiers(previous), domain, DBTime(expiresAt))
 	return err
 }
 
-func (d *DB) DeleteEmailToken(guild discord.GuildID, token Token) error {
+// RehashIdentifier moves everything stored under another identifier for the
+// same email, like an old version of it, over to to. Anything stored under
+// both is merged: to's verification wins, and bans last as long as the longer
+// of the two.
+func (d *sqlStore) RehashIdentifier(guild discord.GuildID, from, to Identifier) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s := `
+		UPDATE banned SET expires_at = (
+			SELECT CASE
+				WHEN banned.expires_at IS NULL OR old.expires_at IS NULL THEN NULL
+				WHEN old.expires_at > banned.expires_at THEN old.expires_at
+				ELSE banned.expires_at
+			END
+			FROM banned AS old WHERE old.guild = $1 AND old.identifier = $2
+		)
+		WHERE guild = $3 AND identifier = $4
+			AND EXISTS (SELECT 1 FROM banned AS old WHERE old.guild = $5 AND old.identifier = $6)
+	`
+	_, err = tx.Exec(s, DBSnowflake(guild), from, DBSnowflake(guild), to, DBSnowflake(guild), from)
+	if err != nil {
+		return fmt.Errorf("error merging bans: %w", err)
+	}
+
+	// each of these can only have one row per identifier, so whatever would
+	// clash with to's row has to go first
+	for _, table := range []string{"verified", "banned"} {
+		s := `
+			DELETE FROM ` + table + ` WHERE guild = $1 AND identifier = $2
+				AND EXISTS (SELECT 1 FROM ` + table + ` AS existing WHERE existing.guild = $3 AND existing.identifier = $4)
+		`
+		_, err = tx.Exec(s, DBSnowflake(guild), from, DBSnowflake(guild), to)
+		if err != nil {
+			return fmt.Errorf("error merging %s: %w", table, err)
+		}
+	}
+
+	for _, table := range []string{"verified", "banned", "email_send"} {
+		s := "UPDATE " + table + " SET identifier = $1 WHERE guild = $2 AND identifier = $3"
+		_, err = tx.Exec(s, to, DBSnowflake(guild), from)
+		if err != nil {
+			return fmt.Errorf("error rehashing %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *sqlStore) DeleteEmailToken(guild discord.GuildID, token Token) error {
 	s := "DELETE FROM token WHERE token = $1 AND guild = $2"
 	_, err := d.db.Exec(s, token[:], DBSnowflake(guild))
 	return err
 }
 
-func (d *DB) GetVerifiedEmail(guild discord.GuildID, id Identifier) (discord.UserID, bool, error) {
-	s := "SELECT user FROM verified WHERE identifier = $1 AND guild = $2"
-	row := d.db.QueryRow(s, id[:], DBSnowflake(guild))
+func (d *sqlStore) GetVerifiedEmail(guild discord.GuildID, id Identifier) (discord.UserID, bool, error) {
+	s := `SELECT "user" FROM verified WHERE identifier = $1 AND guild = $2`
+	row := d.db.QueryRow(s, id, DBSnowflake(guild))
 	var user DBSnowflake
 
 	err := row.Scan(&user)
@@ -144,20 +316,97 @@ func (d *DB) GetVerifiedEmail(guild discord.GuildID, id Identifier) (discord.Use
 	return discord.UserID(user), true, nil
 }
 
-func (d *DB) SetVerifiedEmail(guild discord.GuildID, id Identifier, user discord.UserID, role discord.RoleID) error {
-	s := "INSERT INTO verified (guild, identifier, user, verification_role) VALUES ($1,$2,$3,$4)"
-	_, err := d.db.Exec(s, guild, id[:], DBSnowflake(user), DBSnowflake(role))
+func (d *sqlStore) SetVerifiedEmail(guild discord.GuildID, id Identifier, user discord.UserID, role discord.RoleID, domain string) error {
+	s := `INSERT INTO verified (guild, identifier, "user", verification_role, email_domain, verified_at) VALUES ($1,$2,$3,$4,$5,$6)`
+	_, err := d.db.Exec(s, DBSnowflake(guild), id, DBSnowflake(user), DBSnowflake(role), domain, DBTime(time.Now()))
 	return err
 }
 
-func (d *DB) DeleteVerifiedEmail(guild discord.GuildID, id Identifier) error {
+// Verification is an email that a user verified with.
+type Verification struct {
+	Identifier Identifier
+	Role       discord.RoleID
+	// Domain is empty and VerifiedAt is zero for users that verified before
+	// they were recorded
+	Domain     string
+	VerifiedAt time.Time
+}
+
+func (d *sqlStore) UserVerifications(guild discord.GuildID, user discord.UserID) ([]Verification, error) {
+	s := `SELECT identifier, verification_role, email_domain, verified_at FROM verified WHERE "user" = $1 AND guild = $2`
+	rows, err := d.db.Query(s, DBSnowflake(user), DBSnowflake(guild))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var verifications []Verification
+	for rows.Next() {
+		var v Verification
+		var idBuf []byte
+		var role DBSnowflake
+		var verifiedAt DBTime
+		err = rows.Scan(&idBuf, &role, &v.Domain, &verifiedAt)
+		if err != nil {
+			return nil, err
+		}
+		_, err = v.Identifier.Write(idBuf)
+		if err != nil {
+			return nil, err
+		}
+		v.Role = discord.RoleID(role)
+		v.VerifiedAt = time.Time(verifiedAt)
+		verifications = append(verifications, v)
+	}
+	return verifications, rows.Err()
+}
+
+// VerifiedCounts counts the verified users in each guild.
+func (d *sqlStore) VerifiedCounts() (map[discord.GuildID]int, error) {
+	s := `SELECT guild, COUNT(DISTINCT "user") FROM verified GROUP BY guild`
+	return d.guildCounts(s)
+}
+
+// HasPepperedIdentifiers is whether any verified or banned email has an
+// identifier that was made with a pepper, which only version 0 identifiers
+// are stored without.
+func (d *sqlStore) HasPepperedIdentifiers() (bool, error) {
+	s := `SELECT EXISTS (SELECT 1 FROM verified WHERE length(identifier) = $1)
+		OR EXISTS (SELECT 1 FROM banned WHERE length(identifier) = $2)`
+	var found bool
+	err := d.db.QueryRow(s, IdentifierLength, IdentifierLength).Scan(&found)
+	return found, err
+}
+
+// guildCounts runs a query that selects a guild and a count.
+func (d *sqlStore) guildCounts(s string, args ...any) (map[discord.GuildID]int, error) {
+	rows, err := d.db.Query(s, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[discord.GuildID]int{}
+	for rows.Next() {
+		var guild DBSnowflake
+		var count int
+		err = rows.Scan(&guild, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[discord.GuildID(guild)] = count
+	}
+	return counts, rows.Err()
+}
+
+func (d *sqlStore) DeleteVerifiedEmail(guild discord.GuildID, id Identifier) error {
 	s := "DELETE FROM verified WHERE identifier = $1 AND guild = $2"
-	_, err := d.db.Exec(s, id[:], DBSnowflake(guild))
+	_, err := d.db.Exec(s, id, DBSnowflake(guild))
 	return err
 }
 
-func (d *DB) GetUserIdentifiers(guild discord.GuildID, user discord.UserID) ([]Identifier, error) {
-	s := "SELECT identifier FROM verified WHERE user = $1 AND guild = $2"
+func (d *sqlStore) GetUserIdentifiers(guild discord.GuildID, user discord.UserID) ([]Identifier, error) {
+	s := `SELECT identifier FROM verified WHERE "user" = $1 AND guild = $2`
 	rows, err := d.db.Query(s, DBSnowflake(user), DBSnowflake(guild))
 	if err != nil {
 		return nil, err
@@ -182,21 +431,181 @@ func (d *DB) GetUserIdentifiers(guild discord.GuildID, user discord.UserID) ([]I
 	return ids, nil
 }
 
-func (d *DB) BanEmail(guild discord.GuildID, id Identifier) error {
-	s := "INSERT INTO banned (guild, identifier) VALUES ($1,$2)"
-	_, err := d.db.Exec(s, DBSnowflake(guild), id[:])
-	return err
+// BanRecord is a banned identifier, along with who banned it and why.
+type BanRecord struct {
+	ID         int64
+	Guild      discord.GuildID
+	Identifier Identifier
+	// User is the account that was verified with the identifier, or
+	// zero if it isn't known
+	User      discord.UserID
+	Moderator discord.UserID
+	Reason    string
+	CreatedAt time.Time
+	// ExpiresAt is zero for bans that never expire
+	ExpiresAt time.Time
+}
+
+// BanEmail bans ban.Identifier and returns the ban's ID and when it expires.
+// Banning an identifier that's already banned replaces the old ban's details,
+// except that whichever ban lasts longer decides when it expires.
+func (d *sqlStore) BanEmail(ban BanRecord) (int64, time.Time, error) {
+	// keep the old user if the new ban doesn't know who it is. A null expiry
+	// is a permanent ban, which always lasts longest
+	s := `
+		INSERT INTO banned (guild, identifier, "user", moderator, reason, created_at, expires_at) VALUES ($1,$2,$3,$4,$5,$6,$7)
+		ON CONFLICT (guild, identifier) DO UPDATE SET
+			"user" = CASE WHEN excluded."user" = 0 THEN banned."user" ELSE excluded."user" END,
+			moderator = excluded.moderator,
+			reason = excluded.reason,
+			created_at = excluded.created_at,
+			expires_at = CASE
+				WHEN banned.expires_at IS NULL OR excluded.expires_at IS NULL THEN NULL
+				WHEN banned.expires_at > excluded.expires_at THEN banned.expires_at
+				ELSE excluded.expires_at
+			END
+		RETURNING id, expires_at
+	`
+	row := d.db.QueryRow(s,
+		DBSnowflake(ban.Guild), ban.Identifier, DBSnowflake(ban.User), DBSnowflake(ban.Moderator),
+		ban.Reason, DBTime(ban.CreatedAt), DBTime(ban.ExpiresAt))
+	var id int64
+	var expiresAt DBTime
+	err := row.Scan(&id, &expiresAt)
+	return id, time.Time(expiresAt), err
+}
+
+// UnbanID removes the ban with the given ID, returning false if the guild
+// has no such ban.
+func (d *sqlStore) UnbanID(guild discord.GuildID, id int64) (bool, error) {
+	s := "DELETE FROM banned WHERE id = $1 AND guild = $2"
+	res, err := d.db.Exec(s, id, DBSnowflake(guild))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UnbanUser removes every ban on identifiers the user was verified with,
+// returning how many there were.
+func (d *sqlStore) UnbanUser(guild discord.GuildID, user discord.UserID) (int64, error) {
+	s := `DELETE FROM banned WHERE "user" = $1 AND guild = $2`
+	res, err := d.db.Exec(s, DBSnowflake(user), DBSnowflake(guild))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Bans lists a guild's bans, newest first.
+func (d *sqlStore) Bans(guild discord.GuildID, limit, offset int) ([]BanRecord, error) {
+	s := `
+		SELECT id, guild, identifier, "user", moderator, reason, created_at, expires_at FROM banned
+		WHERE guild = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+	rows, err := d.db.Query(s, DBSnowflake(guild), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []BanRecord
+	for rows.Next() {
+		ban, err := scanBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// scanBan reads a row of
+// id, guild, identifier, "user", moderator, reason, created_at, expires_at
+func scanBan(rows *sql.Rows) (BanRecord, error) {
+	var ban BanRecord
+	var idBuf []byte
+	var guild, user, moderator DBSnowflake
+	var createdAt, expiresAt DBTime
+	err := rows.Scan(&ban.ID, &guild, &idBuf, &user, &moderator, &ban.Reason, &createdAt, &expiresAt)
+	if err != nil {
+		return BanRecord{}, err
+	}
+	_, err = ban.Identifier.Write(idBuf)
+	if err != nil {
+		return BanRecord{}, err
+	}
+	ban.Guild = discord.GuildID(guild)
+	ban.User = discord.UserID(user)
+	ban.Moderator = discord.UserID(moderator)
+	ban.CreatedAt = time.Time(createdAt)
+	ban.ExpiresAt = time.Time(expiresAt)
+	return ban, nil
+}
+
+// GetBan returns the ban on an identifier, ignoring bans that have expired.
+func (d *sqlStore) GetBan(guild discord.GuildID, id Identifier) (BanRecord, bool, error) {
+	s := `
+		SELECT id, guild, identifier, "user", moderator, reason, created_at, expires_at FROM banned
+		WHERE identifier = $1 AND guild = $2 AND (expires_at IS NULL OR expires_at > $3)
+	`
+	rows, err := d.db.Query(s, id, DBSnowflake(guild), DBTime(time.Now()))
+	if err != nil {
+		return BanRecord{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return BanRecord{}, false, rows.Err()
+	}
+	ban, err := scanBan(rows)
+	return ban, err == nil, err
+}
+
+// PurgeExpiredBans deletes bans that expired before now and returns them.
+func (d *sqlStore) PurgeExpiredBans(now time.Time) ([]BanRecord, error) {
+	s := `
+		DELETE FROM banned WHERE expires_at IS NOT NULL AND expires_at <= $1
+		RETURNING id, guild, identifier, "user", moderator, reason, created_at, expires_at
+	`
+	rows, err := d.db.Query(s, DBTime(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []BanRecord
+	for rows.Next() {
+		ban, err := scanBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+func (d *sqlStore) CountBans(guild discord.GuildID) (int, error) {
+	s := "SELECT COUNT(*) FROM banned WHERE guild = $1"
+	row := d.db.QueryRow(s, DBSnowflake(guild))
+	var n int
+	err := row.Scan(&n)
+	return n, err
 }
 
-func (d *DB) UnbanEmail(guild discord.GuildID, id Identifier) error {
+func (d *sqlStore) UnbanEmail(guild discord.GuildID, id Identifier) error {
 	s := "DELETE FROM banned WHERE identifier = $1 AND guild = $2"
-	_, err := d.db.Exec(s, id[:], DBSnowflake(guild))
+	_, err := d.db.Exec(s, id, DBSnowflake(guild))
 	return err
 }
 
-func (d *DB) IsBanned(guild discord.GuildID, id Identifier) (bool, error) {
-	s := "SELECT identifier FROM banned WHERE identifier = $1 AND guild = $2"
-	row := d.db.QueryRow(s, id[:], DBSnowflake(guild))
+// IsBanned ignores bans that have expired but haven't been purged yet.
+func (d *sqlStore) IsBanned(guild discord.GuildID, id Identifier) (bool, error) {
+	s := "SELECT identifier FROM banned WHERE identifier = $1 AND guild = $2 AND (expires_at IS NULL OR expires_at > $3)"
+	row := d.db.QueryRow(s, id, DBSnowflake(guild), DBTime(time.Now()))
 	var tmp []byte
 	err := row.Scan(&tmp)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -215,7 +624,7 @@ func truncateDomain(domain string) string {
 	return string(domainRunes)
 }
 
-func (d *DB) UpdateConfig(guild discord.GuildID, domain string, role discord.RoleID) error {
+func (d *sqlStore) UpdateConfig(guild discord.GuildID, domain string, role discord.RoleID) error {
 	truncDomain := truncateDomain(domain)
 	s := `
 		INSERT INTO config (guild, email_domain, verification_role) VALUES ($1,$2,$3)
@@ -227,13 +636,13 @@ func (d *DB) UpdateConfig(guild discord.GuildID, domain string, role discord.Rol
 	return err
 }
 
-func (d *DB) DeleteConfig(guild discord.GuildID, domain string) error {
+func (d *sqlStore) DeleteConfig(guild discord.GuildID, domain string) error {
 	s := "DELETE FROM config WHERE guild = $1 AND email_domain = $2"
 	_, err := d.db.Exec(s, DBSnowflake(guild), domain)
 	return err
 }
 
-func (d *DB) GetConfig(guild discord.GuildID, domain string) (discord.RoleID, bool, error) {
+func (d *sqlStore) GetConfig(guild discord.GuildID, domain string) (discord.RoleID, bool, error) {
 	s := "SELECT verification_role FROM config WHERE guild = $1 AND email_domain = $2"
 	row := d.db.QueryRow(s, DBSnowflake(guild), domain)
 	var role DBSnowflake
@@ -247,22 +656,82 @@ func (d *DB) GetConfig(guild discord.GuildID, domain string) (discord.RoleID, bo
 	return discord.RoleID(role), true, nil
 }
 
-func (d *DB) EmailDomain(guild discord.GuildID) (string, bool, error) {
-	s := "SELECT email_domain FROM config WHERE guild = $1"
-	row := d.db.QueryRow(s, DBSnowflake(guild))
-	var domain []byte
-	err := row.Scan(&domain)
-	if errors.Is(err, sql.ErrNoRows) {
-		return "", false, nil
-	} else if err != nil {
-		return "", false, err
+// DomainConfig is an email domain that can be verified with, and the role
+// that verifying with it gives.
+type DomainConfig struct {
+	Domain string
+	Role   discord.RoleID
+	// Rules is nil when the domain uses the built-in mailbox rules
+	Rules *MailboxRules
+}
+
+// EmailDomains lists every domain configured in the guild, sorted by domain.
+func (d *sqlStore) EmailDomains(guild discord.GuildID) ([]DomainConfig, error) {
+	s := "SELECT email_domain, verification_role, tag_separators, ignore_dots FROM config WHERE guild = $1 ORDER BY email_domain"
+	rows, err := d.db.Query(s, DBSnowflake(guild))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []DomainConfig
+	for rows.Next() {
+		var domain DomainConfig
+		var role DBSnowflake
+		var tagSeparators sql.NullString
+		var ignoreDots sql.NullInt16
+		err = rows.Scan(&domain.Domain, &role, &tagSeparators, &ignoreDots)
+		if err != nil {
+			return nil, err
+		}
+		domain.Role = discord.RoleID(role)
+		if tagSeparators.Valid {
+			domain.Rules = &MailboxRules{
+				TagSeparators: tagSeparators.String,
+				IgnoreDots:    ignoreDots.Int16 != 0,
+			}
+		}
+		domains = append(domains, domain)
 	}
-	return string(domain), true, nil
+	return domains, rows.Err()
+}
+
+// SetMailboxRules changes how a configured domain's addresses are
+// canonicalized. nil goes back to the built-in rules.
+func (d *sqlStore) SetMailboxRules(guild discord.GuildID, domain string, rules *MailboxRules) error {
+	var tagSeparators sql.NullString
+	var ignoreDots sql.NullInt16
+	if rules != nil {
+		tagSeparators = sql.NullString{String: rules.TagSeparators, Valid: true}
+		ignoreDots = sql.NullInt16{Valid: true}
+		if rules.IgnoreDots {
+			ignoreDots.Int16 = 1
+		}
+	}
+	s := "UPDATE config SET tag_separators = $1, ignore_dots = $2 WHERE guild = $3 AND email_domain = $4"
+	_, err := d.db.Exec(s, tagSeparators, ignoreDots, DBSnowflake(guild), domain)
+	return err
+}
+
+// CountDomainTokens counts the tokens for a domain that haven't been used
+// yet, including expired ones that haven't been cleaned up.
+func (d *sqlStore) CountDomainTokens(guild discord.GuildID, domain string) (int, error) {
+	s := "SELECT COUNT(*) FROM token WHERE guild = $1 AND email_domain = $2"
+	row := d.db.QueryRow(s, DBSnowflake(guild), domain)
+	var n int
+	err := row.Scan(&n)
+	return n, err
+}
+
+func (d *sqlStore) DeleteDomainTokens(guild discord.GuildID, domain string) error {
+	s := "DELETE FROM token WHERE guild = $1 AND email_domain = $2"
+	_, err := d.db.Exec(s, DBSnowflake(guild), domain)
+	return err
 }
 
-func (d *DB) VerificationRole(guild discord.GuildID, id Identifier) (discord.RoleID, bool, error) {
+func (d *sqlStore) VerificationRole(guild discord.GuildID, id Identifier) (discord.RoleID, bool, error) {
 	s := "SELECT verification_role FROM verified WHERE guild = $1 AND identifier = $2"
-	row := d.db.QueryRow(s, DBSnowflake(guild), id[:])
+	row := d.db.QueryRow(s, DBSnowflake(guild), id)
 	var role DBSnowflake
 	err := row.Scan(&role)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -273,9 +742,360 @@ func (d *DB) VerificationRole(guild discord.GuildID, id Identifier) (discord.Rol
 	return discord.RoleID(role), true, nil
 }
 
-// Cleanup removes all tokens that are older than 5 minutes.
-func (d *DB) CleanupTokens() error {
-	s := "DELETE FROM tokens WHERE created_at < NOW() - INTERVAL '5 minutes'"
-	_, err := d.db.Exec(s)
+// CleanupTokens removes all expired tokens.
+func (d *sqlStore) CleanupTokens() error {
+	s := "DELETE FROM token WHERE expires_at <= $1"
+	_, err := d.db.Exec(s, DBTime(time.Now()))
+	return err
+}
+
+const defaultTokenTTL = 15 * time.Minute
+
+// GuildSettings are guild-wide settings, as opposed to the per-domain config.
+type GuildSettings struct {
+	TokenTTL time.Duration
+	// ModLogChannel is discord.NullChannelID if the guild has no mod log
+	ModLogChannel discord.ChannelID
+}
+
+func defaultGuildSettings() GuildSettings {
+	return GuildSettings{
+		TokenTTL:      defaultTokenTTL,
+		ModLogChannel: discord.NullChannelID,
+	}
+}
+
+// GuildSettings returns the default settings if the guild hasn't changed any.
+func (d *sqlStore) GuildSettings(guild discord.GuildID) (GuildSettings, error) {
+	s := "SELECT token_ttl, mod_log_channel FROM guild_settings WHERE guild = $1"
+	row := d.db.QueryRow(s, DBSnowflake(guild))
+	var ttlSeconds int64
+	var modLog DBSnowflake
+	err := row.Scan(&ttlSeconds, &modLog)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultGuildSettings(), nil
+	} else if err != nil {
+		return GuildSettings{}, err
+	}
+
+	settings := GuildSettings{
+		TokenTTL:      time.Duration(ttlSeconds) * time.Second,
+		ModLogChannel: discord.ChannelID(modLog),
+	}
+	if modLog == 0 {
+		settings.ModLogChannel = discord.NullChannelID
+	}
+	return settings, nil
+}
+
+func (d *sqlStore) SetTokenTTL(guild discord.GuildID, ttl time.Duration) error {
+	s := `
+		INSERT INTO guild_settings (guild, token_ttl) VALUES ($1,$2)
+		ON CONFLICT (guild) DO UPDATE
+		SET token_ttl = excluded.token_ttl
+	`
+	_, err := d.db.Exec(s, DBSnowflake(guild), int64(ttl/time.Second))
+	return err
+}
+
+// SetModLogChannel disables the mod log if channel is discord.NullChannelID.
+func (d *sqlStore) SetModLogChannel(guild discord.GuildID, channel discord.ChannelID) error {
+	if !channel.IsValid() {
+		channel = 0
+	}
+	s := `
+		INSERT INTO guild_settings (guild, mod_log_channel) VALUES ($1,$2)
+		ON CONFLICT (guild) DO UPDATE
+		SET mod_log_channel = excluded.mod_log_channel
+	`
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(channel))
+	return err
+}
+
+func (d *sqlStore) DeleteUserTokens(guild discord.GuildID, user discord.UserID) error {
+	s := `DELETE FROM token WHERE guild = $1 AND "user" = $2`
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(user))
+	return err
+}
+
+// VerifyLockedUntil returns the zero time if user isn't locked out of /verify.
+func (d *sqlStore) VerifyLockedUntil(guild discord.GuildID, user discord.UserID) (time.Time, error) {
+	s := `SELECT locked_until FROM verify_failure WHERE guild = $1 AND "user" = $2`
+	row := d.db.QueryRow(s, DBSnowflake(guild), DBSnowflake(user))
+	var lockedUntil DBTime
+	err := row.Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Time(lockedUntil), nil
+}
+
+// RecordVerifyFailure counts a wrong token against user. If it was one too
+// many, they are locked out and the end of their lockout is returned.
+func (d *sqlStore) RecordVerifyFailure(guild discord.GuildID, user discord.UserID, policy LockoutPolicy) (time.Time, bool, error) {
+	now := time.Now()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	s := `
+		INSERT INTO verify_failure (guild, "user", last_failure_at) VALUES ($1,$2,$3)
+		ON CONFLICT (guild, "user") DO NOTHING
+	`
+	_, err = tx.Exec(s, DBSnowflake(guild), DBSnowflake(user), DBTime(now))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	// the update locks the row, so concurrent failures can't both miss the
+	// limit
+	s = `
+		UPDATE verify_failure
+		SET failures = CASE WHEN last_failure_at < $1 THEN 1 ELSE failures + 1 END,
+			last_failure_at = $2
+		WHERE guild = $3 AND "user" = $4
+		RETURNING failures, lockouts
+	`
+	row := tx.QueryRow(s, DBTime(now.Add(-policy.Window)), DBTime(now), DBSnowflake(guild), DBSnowflake(user))
+	var failures, lockouts int
+	err = row.Scan(&failures, &lockouts)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if failures < policy.Limit {
+		return time.Time{}, false, tx.Commit()
+	}
+
+	lockouts++
+	lockedUntil := now.Add(policy.Duration(lockouts))
+	s = `UPDATE verify_failure SET failures = 0, lockouts = $1, locked_until = $2 WHERE guild = $3 AND "user" = $4`
+	_, err = tx.Exec(s, lockouts, DBTime(lockedUntil), DBSnowflake(guild), DBSnowflake(user))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return lockedUntil, true, tx.Commit()
+}
+
+func (d *sqlStore) ResetVerifyFailures(guild discord.GuildID, user discord.UserID) error {
+	s := `DELETE FROM verify_failure WHERE guild = $1 AND "user" = $2`
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(user))
+	return err
+}
+
+// CleanupVerifyFailures forgets about users who haven't failed since before
+// and aren't locked out, so their next lockout starts short again.
+func (d *sqlStore) CleanupVerifyFailures(before time.Time) error {
+	s := "DELETE FROM verify_failure WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)"
+	_, err := d.db.Exec(s, DBTime(before), DBTime(time.Now()))
+	return err
+}
+
+// RateLimits returns the guild's rate limits, using the defaults for any it
+// hasn't overridden.
+func (d *sqlStore) RateLimits(guild discord.GuildID) (map[RateLimitScope]RateLimit, error) {
+	limits := make(map[RateLimitScope]RateLimit, len(defaultRateLimits))
+	for scope, limit := range defaultRateLimits {
+		limits[scope] = limit
+	}
+
+	s := "SELECT scope, max_count, window_seconds FROM rate_limit WHERE guild = $1"
+	rows, err := d.db.Query(s, DBSnowflake(guild))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scope string
+		var count int
+		var windowSeconds int64
+		err = rows.Scan(&scope, &count, &windowSeconds)
+		if err != nil {
+			return nil, err
+		}
+		limits[RateLimitScope(scope)] = RateLimit{
+			Count:  count,
+			Window: time.Duration(windowSeconds) * time.Second,
+		}
+	}
+	return limits, rows.Err()
+}
+
+func (d *sqlStore) SetRateLimit(guild discord.GuildID, scope RateLimitScope, limit RateLimit) error {
+	s := `
+		INSERT INTO rate_limit (guild, scope, max_count, window_seconds) VALUES ($1,$2,$3,$4)
+		ON CONFLICT (guild, scope) DO UPDATE
+		SET max_count = excluded.max_count,
+			window_seconds = excluded.window_seconds
+	`
+	_, err := d.db.Exec(s, DBSnowflake(guild), string(scope), limit.Count, int64(limit.Window/time.Second))
+	return err
+}
+
+func (d *sqlStore) RecordEmailSend(guild discord.GuildID, user discord.UserID, id Identifier) error {
+	s := `INSERT INTO email_send (guild, "user", identifier, sent_at) VALUES ($1,$2,$3,$4)`
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(user), id, DBTime(time.Now()))
+	return err
+}
+
+// RecentEmailSends returns when the latest n emails counted by scope were sent
+// since the given time, newest first.
+func (d *sqlStore) RecentEmailSends(guild discord.GuildID, scope RateLimitScope, user discord.UserID, id Identifier, since time.Time, n int) ([]time.Time, error) {
+	var rows *sql.Rows
+	var err error
+	switch scope {
+	case RateLimitUser:
+		s := `SELECT sent_at FROM email_send WHERE guild = $1 AND "user" = $2 AND sent_at > $3 ORDER BY sent_at DESC LIMIT $4`
+		rows, err = d.db.Query(s, DBSnowflake(guild), DBSnowflake(user), DBTime(since), n)
+	case RateLimitEmail:
+		s := "SELECT sent_at FROM email_send WHERE guild = $1 AND identifier = $2 AND sent_at > $3 ORDER BY sent_at DESC LIMIT $4"
+		rows, err = d.db.Query(s, DBSnowflake(guild), id, DBTime(since), n)
+	case RateLimitGuild:
+		s := "SELECT sent_at FROM email_send WHERE guild = $1 AND sent_at > $2 ORDER BY sent_at DESC LIMIT $3"
+		rows, err = d.db.Query(s, DBSnowflake(guild), DBTime(since), n)
+	default:
+		return nil, fmt.Errorf("unknown rate limit scope %q", scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sends []time.Time
+	for rows.Next() {
+		var sentAt DBTime
+		err = rows.Scan(&sentAt)
+		if err != nil {
+			return nil, err
+		}
+		sends = append(sends, time.Time(sentAt))
+	}
+	return sends, rows.Err()
+}
+
+func (d *sqlStore) CleanupEmailSends(before time.Time) error {
+	s := "DELETE FROM email_send WHERE sent_at < $1"
+	_, err := d.db.Exec(s, DBTime(before))
+	return err
+}
+
+func (d *sqlStore) EnqueueEmail(e OutboxEmail) (int64, error) {
+	s := `
+		INSERT INTO outbox (guild, "user", app_id, interaction_token, recipient, subject, body, html_body, next_attempt_at, created_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		RETURNING id
+	`
+	now := DBTime(time.Now())
+	row := d.db.QueryRow(s,
+		DBSnowflake(e.Guild), DBSnowflake(e.User), DBSnowflake(e.AppID), e.InteractionToken,
+		e.Email.To, e.Email.Subject, e.Email.Body, e.Email.HTML, now, now)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+// ClaimEmail takes the next email that's due for sending, so that no other
+// worker sends it until lease has passed.
+func (d *sqlStore) ClaimEmail(lease time.Duration) (OutboxEmail, bool, error) {
+	now := time.Now()
+	// the status is checked again outside of the subquery, so when two
+	// workers pick the same email only the first one gets it
+	s := `
+		UPDATE outbox SET status = 'sending', attempts = attempts + 1, locked_until = $1
+		WHERE id = (
+			SELECT id FROM outbox
+			WHERE (status = 'pending' AND next_attempt_at <= $2) OR (status = 'sending' AND locked_until < $3)
+			ORDER BY next_attempt_at
+			LIMIT 1
+		) AND (status = 'pending' OR locked_until < $4)
+		RETURNING id, guild, "user", app_id, interaction_token, recipient, subject, body, html_body, attempts
+	`
+	row := d.db.QueryRow(s, DBTime(now.Add(lease)), DBTime(now), DBTime(now), DBTime(now))
+
+	var e OutboxEmail
+	var guild, user, appID DBSnowflake
+	err := row.Scan(&e.ID, &guild, &user, &appID, &e.InteractionToken, &e.Email.To, &e.Email.Subject, &e.Email.Body, &e.Email.HTML, &e.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OutboxEmail{}, false, nil
+	} else if err != nil {
+		return OutboxEmail{}, false, err
+	}
+	e.Guild = discord.GuildID(guild)
+	e.User = discord.UserID(user)
+	e.AppID = discord.AppID(appID)
+	return e, true, nil
+}
+
+// MarkEmailSent finishes with an email, clearing everything personal in it
+// since it won't be sent again.
+func (d *sqlStore) MarkEmailSent(id int64) error {
+	s := "UPDATE outbox SET status = 'sent', recipient = '', body = '', html_body = '', interaction_token = '', locked_until = NULL WHERE id = $1"
+	_, err := d.db.Exec(s, id)
+	return err
+}
+
+func (d *sqlStore) RetryEmail(id int64, at time.Time, lastError string) error {
+	s := "UPDATE outbox SET status = 'pending', next_attempt_at = $1, locked_until = NULL, last_error = $2 WHERE id = $3"
+	_, err := d.db.Exec(s, DBTime(at), lastError, id)
+	return err
+}
+
+// MarkEmailDead gives up on sending an email, clearing it like MarkEmailSent.
+func (d *sqlStore) MarkEmailDead(id int64, lastError string) error {
+	s := "UPDATE outbox SET status = 'dead', recipient = '', body = '', html_body = '', interaction_token = '', locked_until = NULL, last_error = $1 WHERE id = $2"
+	_, err := d.db.Exec(s, lastError, id)
+	return err
+}
+
+// CleanupOutbox removes sent and dead emails created before the given time.
+func (d *sqlStore) CleanupOutbox(before time.Time) error {
+	s := "DELETE FROM outbox WHERE status IN ('sent', 'dead') AND created_at < $1"
+	_, err := d.db.Exec(s, DBTime(before))
+	return err
+}
+
+// EmailTemplate returns an empty template if the guild hasn't customized it.
+func (d *sqlStore) EmailTemplate(guild discord.GuildID) (EmailTemplate, error) {
+	s := "SELECT subject, intro, support_contact, text_body, html_body FROM email_template WHERE guild = $1"
+	row := d.db.QueryRow(s, DBSnowflake(guild))
+	var t EmailTemplate
+	err := row.Scan(&t.Subject, &t.Intro, &t.SupportContact, &t.Text, &t.HTML)
+	if errors.Is(err, sql.ErrNoRows) {
+		return EmailTemplate{}, nil
+	}
+	return t, err
+}
+
+func (d *sqlStore) SetEmailTemplate(guild discord.GuildID, t EmailTemplate) error {
+	s := `
+		INSERT INTO email_template (guild, subject, intro, support_contact, text_body, html_body) VALUES ($1,$2,$3,$4,$5,$6)
+		ON CONFLICT (guild) DO UPDATE
+		SET subject = excluded.subject,
+			intro = excluded.intro,
+			support_contact = excluded.support_contact,
+			text_body = excluded.text_body,
+			html_body = excluded.html_body
+	`
+	_, err := d.db.Exec(s, DBSnowflake(guild), t.Subject, t.Intro, t.SupportContact, t.Text, t.HTML)
+	return err
+}
+
+func (d *sqlStore) DeleteEmailTemplate(guild discord.GuildID) error {
+	s := "DELETE FROM email_template WHERE guild = $1"
+	_, err := d.db.Exec(s, DBSnowflake(guild))
+	return err
+}
+
+// RecordLookup adds a /lookup of id by moderator to the audit log. found is
+// the user that was verified with id, or zero if there wasn't one.
+func (d *sqlStore) RecordLookup(guild discord.GuildID, moderator discord.UserID, id Identifier, found discord.UserID) error {
+	s := "INSERT INTO lookup_audit (guild, moderator, identifier, found_user, created_at) VALUES ($1,$2,$3,$4,$5)"
+	_, err := d.db.Exec(s, DBSnowflake(guild), DBSnowflake(moderator), id, DBSnowflake(found), DBTime(time.Now()))
 	return err
 }
@@ -2,12 +2,206 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"math"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/diamondburned/arikawa/v3/discord"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// newTestStore opens an empty store. Tests run against an in-memory SQLite
+// database, or against Postgres when $DATABASE_URL is a Postgres URL.
+func newTestStore(t *testing.T) *sqlStore {
+	if postgresTestURL() != "" {
+		return &newPostgresTestStore(t).sqlStore
+	}
+	store, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return &store.sqlStore
+}
+
+// testMigrations are the migrations of whichever database newTestStore uses.
+func testMigrations() migrationDialect {
+	if postgresTestURL() != "" {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+func TestStoreVerified(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	const role = discord.RoleID(3)
+	id := Identifier{1, 2, 3}
+
+	err := store.SetVerifiedEmail(guild, id, user, role, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actualUser, ok, err := store.GetVerifiedEmail(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || actualUser != user {
+		t.Errorf("expected user %v, got %v (ok: %v)", user, actualUser, ok)
+	}
+
+	ids, err := store.GetUserIdentifiers(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected identifiers [%v], got %v", id, ids)
+	}
+
+	counts, err := store.VerifiedCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[discord.GuildID]int{guild: 1}) {
+		t.Errorf("expected 1 verified user in guild %v, got %v", guild, counts)
+	}
+
+	verifications, err := store.UserVerifications(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 || verifications[0].Identifier != id || verifications[0].Role != role ||
+		verifications[0].Domain != "example.com" || verifications[0].VerifiedAt.IsZero() {
+		t.Errorf("expected a verification of %v with role %v for example.com, got %+v", id, role, verifications)
+	}
+
+	actualRole, ok, err := store.VerificationRole(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || actualRole != role {
+		t.Errorf("expected role %v, got %v (ok: %v)", role, actualRole, ok)
+	}
+
+	err = store.DeleteVerifiedEmail(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = store.GetVerifiedEmail(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected verified email to be deleted")
+	}
+}
+
+func TestStoreToken(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	const role = discord.RoleID(3)
+	id := Identifier{1, 2, 3}
+	token := MakeToken()
+
+	err := store.UpdateConfig(guild, "example.com", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetEmailToken(guild, user, id, nil, token, "example.com", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailToken, ok, err := store.GetEmailToken(guild, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := EmailToken{Identifier: id, User: user, Role: role, Domain: "example.com"}
+	if !ok || !reflect.DeepEqual(emailToken, expected) {
+		t.Errorf("expected %+v, got %+v (ok: %v)", expected, emailToken, ok)
+	}
+
+	_, ok, err = store.GetEmailToken(guild+1, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("token should not be valid in another guild")
+	}
+
+	expired := MakeToken()
+	err = store.SetEmailToken(guild, user, id, nil, expired, "example.com", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.GetEmailToken(guild, expired)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+
+	// the expired token isn't pending, the valid one is
+	expiresAt, ok, err := store.PendingTokenExpiry(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !expiresAt.After(time.Now()) {
+		t.Errorf("expected a pending token, got %v (ok: %v)", expiresAt, ok)
+	}
+	counts, err := store.PendingTokenCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[discord.GuildID]int{guild: 1}) {
+		t.Errorf("expected 1 pending token in guild %v, got %v", guild, counts)
+	}
+
+	err = store.CleanupTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = store.GetEmailToken(guild, expired)
+	if err != nil || ok {
+		t.Errorf("expected expired token to be cleaned up, got ok: %v, err: %v", ok, err)
+	}
+	_, ok, err = store.GetEmailToken(guild, token)
+	if err != nil || !ok {
+		t.Errorf("expected valid token to survive cleanup, got ok: %v, err: %v", ok, err)
+	}
+}
+
+func TestStoreGuildSettings(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+
+	settings, err := store.GuildSettings(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings != defaultGuildSettings() {
+		t.Errorf("expected default settings, got %+v", settings)
+	}
+
+	err = store.SetTokenTTL(guild, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err = store.GuildSettings(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.TokenTTL != time.Hour {
+		t.Errorf("expected token TTL of %v, got %v", time.Hour, settings.TokenTTL)
+	}
+}
+
 func TestDBSnowflake(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -168,3 +362,601 @@ func FuzzDBSnowflake(f *testing.F) {
 		f.Error(err)
 	}
 }
+
+func TestStoreVerifyFailures(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	policy := LockoutPolicy{Limit: 3, Window: time.Hour, Base: time.Minute, Max: time.Hour}
+
+	for i := 1; i < policy.Limit; i++ {
+		_, locked, err := store.RecordVerifyFailure(guild, user, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked {
+			t.Fatalf("locked out after %v failures, expected %v", i, policy.Limit)
+		}
+	}
+
+	lockedUntil, locked, err := store.RecordVerifyFailure(guild, user, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatalf("expected lockout after %v failures", policy.Limit)
+	}
+
+	actual, err := store.VerifyLockedUntil(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Unix() != lockedUntil.Unix() {
+		t.Errorf("expected to be locked until %v, got %v", lockedUntil, actual)
+	}
+
+	err = store.ResetVerifyFailures(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err = store.VerifyLockedUntil(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !actual.IsZero() {
+		t.Errorf("expected lockout to be reset, got %v", actual)
+	}
+}
+
+func TestLockoutPolicyDuration(t *testing.T) {
+	policy := LockoutPolicy{Base: time.Minute, Max: time.Hour}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for i, d := range expected {
+		if actual := policy.Duration(i + 1); actual != d {
+			t.Errorf("lockout %v: expected %v, got %v", i+1, d, actual)
+		}
+	}
+	if actual := policy.Duration(100); actual != time.Hour {
+		t.Errorf("expected lockouts to be capped at %v, got %v", time.Hour, actual)
+	}
+}
+
+func TestStoreRateLimits(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	id := Identifier{1, 2, 3}
+
+	limits, err := store.RateLimits(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[RateLimitUser] != defaultRateLimits[RateLimitUser] {
+		t.Errorf("expected default user rate limit, got %+v", limits[RateLimitUser])
+	}
+
+	custom := RateLimit{Count: 1, Window: time.Minute}
+	err = store.SetRateLimit(guild, RateLimitUser, custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err = store.RateLimits(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[RateLimitUser] != custom {
+		t.Errorf("expected user rate limit %+v, got %+v", custom, limits[RateLimitUser])
+	}
+
+	for i := 0; i < 3; i++ {
+		err = store.RecordEmailSend(guild, user, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := time.Now().Add(-time.Hour)
+	for _, scope := range []RateLimitScope{RateLimitUser, RateLimitEmail, RateLimitGuild} {
+		sends, err := store.RecentEmailSends(guild, scope, user, id, since, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sends) != 2 {
+			t.Errorf("%v: expected 2 sends, got %v", scope, len(sends))
+		}
+	}
+
+	sends, err := store.RecentEmailSends(guild, RateLimitUser, user+1, id, since, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sends) != 0 {
+		t.Errorf("expected no sends for another user, got %v", len(sends))
+	}
+}
+
+func TestStoreOutbox(t *testing.T) {
+	store := newTestStore(t)
+
+	e := OutboxEmail{
+		Guild:            1,
+		User:             2,
+		AppID:            3,
+		InteractionToken: "interaction",
+		Email:            Email{To: "someone@example.com", Subject: "subject", Body: "body"},
+	}
+	id, err := store.EnqueueEmail(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, ok, err := store.ClaimEmail(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ID = id
+	e.Attempts = 1
+	if !ok || claimed != e {
+		t.Fatalf("expected to claim %+v, got %+v (ok: %v)", e, claimed, ok)
+	}
+
+	// nobody else can claim it while it's being sent
+	_, ok, err = store.ClaimEmail(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("claimed an email that's already being sent")
+	}
+
+	// or before it's due to be retried
+	err = store.RetryEmail(id, time.Now().Add(time.Hour), "oops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = store.ClaimEmail(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("claimed an email before its retry was due")
+	}
+
+	err = store.RetryEmail(id, time.Now().Add(-time.Second), "oops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, ok, err = store.ClaimEmail(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || claimed.Attempts != 2 {
+		t.Fatalf("expected to claim the retry on attempt 2, got %+v (ok: %v)", claimed, ok)
+	}
+
+	err = store.MarkEmailSent(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOutboxCleared(t, store, id)
+
+	id, err = store.EnqueueEmail(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.MarkEmailDead(id, "oops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOutboxCleared(t, store, id)
+}
+
+// assertOutboxCleared checks that nothing personal is left in a finished email.
+func assertOutboxCleared(t *testing.T, store *sqlStore, id int64) {
+	t.Helper()
+	var recipient, body, html, interactionToken string
+	s := "SELECT recipient, body, html_body, interaction_token FROM outbox WHERE id = $1"
+	err := store.db.QueryRow(s, id).Scan(&recipient, &body, &html, &interactionToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient != "" || body != "" || html != "" || interactionToken != "" {
+		t.Errorf("expected the email to be cleared, got recipient %q, body %q, html %q and interaction token %q",
+			recipient, body, html, interactionToken)
+	}
+}
+
+func TestStoreBans(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	const moderator = discord.UserID(3)
+	id := Identifier{1, 2, 3}
+
+	ban := BanRecord{
+		Guild:      guild,
+		Identifier: id,
+		User:       user,
+		Moderator:  moderator,
+		Reason:     "spam",
+		CreatedAt:  time.Unix(1000, 0),
+	}
+	banID, _, err := store.BanEmail(ban)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned, err := store.IsBanned(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !banned {
+		t.Error("expected identifier to be banned")
+	}
+
+	// banning again updates the ban, without forgetting who it was
+	ban.User = 0
+	ban.Reason = "more spam"
+	newBanID, _, err := store.BanEmail(ban)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBanID != banID {
+		t.Errorf("expected rebanning to keep ban id %v, got %v", banID, newBanID)
+	}
+
+	bans, err := store.Bans(guild, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ban.ID = banID
+	ban.User = user
+	if len(bans) != 1 || bans[0] != ban {
+		t.Errorf("expected bans [%+v], got %+v", ban, bans)
+	}
+	count, err := store.CountBans(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 ban, got %v", count)
+	}
+
+	ok, err := store.UnbanID(guild+1, banID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("unbanned a ban from a different guild")
+	}
+	n, err := store.UnbanUser(guild, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected to unban 1 identifier, got %v", n)
+	}
+	ok, err = store.UnbanID(guild, banID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("unbanned a ban that was already removed")
+	}
+}
+
+func TestStoreTemporaryBans(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	expired := BanRecord{Guild: guild, Identifier: Identifier{1}, ExpiresAt: time.Now().Add(-time.Minute)}
+	active := BanRecord{Guild: guild, Identifier: Identifier{2}, ExpiresAt: time.Now().Add(time.Hour)}
+	permanent := BanRecord{Guild: guild, Identifier: Identifier{3}}
+	for _, ban := range []BanRecord{expired, active, permanent} {
+		_, _, err := store.BanEmail(ban)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ban := range []BanRecord{expired, active, permanent} {
+		banned, err := store.IsBanned(guild, ban.Identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ban.Identifier != expired.Identifier
+		if banned != expected {
+			t.Errorf("expected %v to be banned: %v, got %v", ban.Identifier[0], expected, banned)
+		}
+		_, ok, err := store.GetBan(guild, ban.Identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("expected to get ban of %v: %v, got %v", ban.Identifier[0], expected, ok)
+		}
+	}
+
+	purged, err := store.PurgeExpiredBans(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].Identifier != expired.Identifier || purged[0].Guild != guild {
+		t.Errorf("expected to purge only the expired ban, got %+v", purged)
+	}
+	count, err := store.CountBans(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 bans left, got %v", count)
+	}
+
+	// a shorter ban doesn't cut a longer one short
+	_, expiresAt, err := store.BanEmail(BanRecord{Guild: guild, Identifier: permanent.Identifier, ExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.IsZero() {
+		t.Errorf("expected the permanent ban to stay permanent, got an expiry of %v", expiresAt)
+	}
+	_, expiresAt, err = store.BanEmail(BanRecord{Guild: guild, Identifier: active.Identifier, ExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt.Unix() != active.ExpiresAt.Unix() {
+		t.Errorf("expected the longer ban's expiry %v to be kept, got %v", active.ExpiresAt, expiresAt)
+	}
+	// but a longer one extends it
+	_, expiresAt, err = store.BanEmail(BanRecord{Guild: guild, Identifier: active.Identifier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.IsZero() {
+		t.Errorf("expected the ban to become permanent, got an expiry of %v", expiresAt)
+	}
+}
+
+func TestStoreLookupAudit(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const moderator = discord.UserID(2)
+	const found = discord.UserID(3)
+	id := Identifier{1, 2, 3}
+
+	err := store.RecordLookup(guild, moderator, id, found)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actualModerator, actualFound DBSnowflake
+	var createdAt DBTime
+	row := store.db.QueryRow("SELECT moderator, found_user, created_at FROM lookup_audit WHERE guild = $1", DBSnowflake(guild))
+	err = row.Scan(&actualModerator, &actualFound, &createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discord.UserID(actualModerator) != moderator || discord.UserID(actualFound) != found || time.Time(createdAt).IsZero() {
+		t.Errorf("expected lookup of %v by %v, got %v by %v at %v", found, moderator, actualFound, actualModerator, time.Time(createdAt))
+	}
+}
+
+func TestStoreDomains(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	expected := []DomainConfig{{Domain: "a.example.com", Role: 3}, {Domain: "b.example.com", Role: 2}}
+	for i := len(expected) - 1; i >= 0; i-- {
+		err := store.UpdateConfig(guild, expected[i].Domain, expected[i].Role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	domains, err := store.EmailDomains(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("expected domains %v, got %v", expected, domains)
+	}
+
+	err = store.SetEmailToken(guild, 4, Identifier{1}, nil, MakeToken(), "a.example.com", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &MailboxRules{TagSeparators: "+", IgnoreDots: true}
+	err = store.SetMailboxRules(guild, "b.example.com", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[1].Rules = rules
+	domains, err = store.EmailDomains(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("expected domains %v, got %v", expected, domains)
+	}
+
+	n, err := store.CountDomainTokens(guild, "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 token for a.example.com, got %v", n)
+	}
+
+	err = store.DeleteDomainTokens(guild, "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.DeleteConfig(guild, "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, err = store.EmailDomains(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, expected[1:]) {
+		t.Errorf("expected domains %v, got %v", expected[1:], domains)
+	}
+}
+
+func TestStoreRehashIdentifier(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const user = discord.UserID(2)
+	const role = discord.RoleID(3)
+	legacy := Identifier{identifierV0, 1}
+	id := Identifier{identifierV1, 1}
+
+	err := store.UpdateConfig(guild, "example.com", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := MakeToken()
+	previous := []Identifier{legacy, {identifierV1, 2}}
+	err = store.SetEmailToken(guild, user, id, previous, token, "example.com", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailToken, ok, err := store.GetEmailToken(guild, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !reflect.DeepEqual(emailToken.Previous, previous) {
+		t.Fatalf("expected token with previous identifiers %v, got %+v (ok: %v)", previous, emailToken, ok)
+	}
+
+	err = store.SetVerifiedEmail(guild, legacy, user, role, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.BanEmail(BanRecord{Guild: guild, Identifier: legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.RehashIdentifier(guild, legacy, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualUser, ok, err := store.GetVerifiedEmail(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || actualUser != user {
+		t.Errorf("expected %v to be verified under the new identifier, got %v (ok: %v)", user, actualUser, ok)
+	}
+	banned, err := store.IsBanned(guild, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !banned {
+		t.Error("expected the ban to move to the new identifier")
+	}
+	_, ok, err = store.GetVerifiedEmail(guild, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected nothing left under the legacy identifier")
+	}
+}
+
+func TestStoreRehashIdentifierMerges(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	const role = discord.RoleID(3)
+	from := Identifier{identifierV0, 1}
+	to := Identifier{identifierV1, 1}
+
+	// the same email verified and banned under both identifiers
+	err := store.SetVerifiedEmail(guild, from, 4, role, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetVerifiedEmail(guild, to, 5, role, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.BanEmail(BanRecord{Guild: guild, Identifier: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.BanEmail(BanRecord{Guild: guild, Identifier: to, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.RehashIdentifier(guild, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, ok, err := store.GetVerifiedEmail(guild, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || user != 5 {
+		t.Errorf("expected the newer verification to be kept, got %v (ok: %v)", user, ok)
+	}
+	_, ok, err = store.GetVerifiedEmail(guild, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected nothing left under the old identifier")
+	}
+
+	ban, ok, err := store.GetBan(guild, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !ban.ExpiresAt.IsZero() {
+		t.Errorf("expected the merged ban to be permanent, got %+v (ok: %v)", ban, ok)
+	}
+	count, err := store.CountBans(guild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected the bans to be merged into 1, got %v", count)
+	}
+}
+
+func TestStoreHasPepperedIdentifiers(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	err := store.SetVerifiedEmail(guild, Identifier{identifierV0, 1}, 4, 3, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peppered, err := store.HasPepperedIdentifiers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peppered {
+		t.Error("expected a version 0 identifier not to count as peppered")
+	}
+
+	_, _, err = store.BanEmail(BanRecord{Guild: guild, Identifier: Identifier{identifierV1, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peppered, err = store.HasPepperedIdentifiers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peppered {
+		t.Error("expected a banned version 1 identifier to count as peppered")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Configured domains are patterns. A plain domain like uvic.ca only matches
+// itself, and a wildcard like *.uvic.ca matches every subdomain of uvic.ca
+// (cs.uvic.ca, mail.cs.uvic.ca) but not uvic.ca itself. When an email matches
+// several patterns, the most specific one decides the role: an exact match
+// beats any wildcard, and *.cs.uvic.ca beats *.uvic.ca.
+
+const wildcardPrefix = "*."
+
+// canonicalDomain lowercases domain and converts international domains to
+// punycode, so that BÜCHER.example and xn--bcher-kva.example are the same.
+func canonicalDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	if ascii == "" || !strings.Contains(ascii, ".") {
+		return "", errors.New("domain must have at least two parts")
+	}
+	return ascii, nil
+}
+
+// normalizeDomain canonicalizes a domain pattern typed in by an admin, and
+// forgives a leading @.
+func normalizeDomain(pattern string) (string, error) {
+	pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "@")
+	wildcard := strings.HasPrefix(pattern, wildcardPrefix)
+	domain, err := canonicalDomain(strings.TrimPrefix(pattern, wildcardPrefix))
+	if err != nil {
+		return "", err
+	}
+	if wildcard {
+		return wildcardPrefix + domain, nil
+	}
+	return domain, nil
+}
+
+// matchesDomain checks whether a canonical domain matches pattern.
+func matchesDomain(pattern, domain string) bool {
+	if strings.HasPrefix(pattern, wildcardPrefix) {
+		return strings.HasSuffix(domain, "."+strings.TrimPrefix(pattern, wildcardPrefix))
+	}
+	return domain == pattern
+}
+
+// specificity ranks patterns for matchDomain, higher is more specific.
+func specificity(pattern string) int {
+	if strings.HasPrefix(pattern, wildcardPrefix) {
+		return strings.Count(pattern, ".")
+	}
+	// exact matches always win
+	return int(^uint(0) >> 1)
+}
+
+// matchDomain picks the configured domain that a canonical email domain
+// belongs to.
+func matchDomain(domains []DomainConfig, domain string) (DomainConfig, bool) {
+	var best DomainConfig
+	found := false
+	for _, config := range domains {
+		if !matchesDomain(config.Domain, domain) {
+			continue
+		}
+		if !found || specificity(config.Domain) > specificity(best.Domain) {
+			best = config
+			found = true
+		}
+	}
+	return best, found
+}
+
+// MailboxRules say which addresses of a domain end up in the same inbox, so
+// that they can be given the same identifier.
+type MailboxRules struct {
+	// TagSeparators are the characters that start a sub-address tag, like
+	// the + in someone+tag@gmail.com. Everything after one is ignored.
+	TagSeparators string
+	// IgnoreDots is for domains like gmail.com, where first.last and
+	// firstlast are the same inbox.
+	IgnoreDots bool
+}
+
+// builtinMailboxRules are used for domains that don't have their own rules.
+// Domains that aren't listed are left alone, since most schools and
+// workplaces hand out addresses that really can contain a dot, but see
+// allowsPlus.
+var builtinMailboxRules = map[string]MailboxRules{
+	"gmail.com":      {TagSeparators: "+", IgnoreDots: true},
+	"googlemail.com": {TagSeparators: "+", IgnoreDots: true},
+	"outlook.com":    {TagSeparators: "+"},
+	"hotmail.com":    {TagSeparators: "+"},
+	"live.com":       {TagSeparators: "+"},
+	"icloud.com":     {TagSeparators: "+"},
+	"proton.me":      {TagSeparators: "+"},
+	"protonmail.com": {TagSeparators: "+"},
+	"fastmail.com":   {TagSeparators: "+"},
+	"yahoo.com":      {TagSeparators: "-"},
+}
+
+// mailboxRules returns the rules for an email domain matched by config.
+func (config DomainConfig) mailboxRules(domain string) MailboxRules {
+	if config.Rules != nil {
+		return *config.Rules
+	}
+	return builtinMailboxRules[domain]
+}
+
+// allowsPlus is whether addresses of a domain matched by config can contain a
+// +. A + usually starts an alias that goes to the same inbox, so it's only
+// allowed when the rules ignore it, or when admins have set rules for the
+// domain and so know what its addresses look like.
+func (config DomainConfig) allowsPlus(domain string) bool {
+	return config.Rules != nil || strings.Contains(config.mailboxRules(domain).TagSeparators, "+")
+}
+
+// canonicalMailbox applies rules to a parsed email.
+func canonicalMailbox(email string, rules MailboxRules) string {
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at:]
+	// a tag at the very start would leave nothing behind
+	if i := strings.IndexAny(local, rules.TagSeparators); i > 0 {
+		local = local[:i]
+	}
+	if rules.IgnoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + domain
+}
+
+// mailboxVariants returns the addresses a parsed email canonicalizes to under
+// each set of rules its domain has had, starting with the current one: its
+// config's rules now, the built-in rules before admins set any, and none at
+// all before mailboxes were canonicalized. Each of those folded the email
+// into the same inbox, so it may already be stored under any of them. Other
+// rules are never tried, since on a domain without them addresses that only
+// differ by a dot or a tag can belong to different people.
+func mailboxVariants(config DomainConfig, email string) []string {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	ruleSets := []MailboxRules{config.mailboxRules(domain), builtinMailboxRules[domain]}
+	// addresses with a + were refused before there were rules
+	if local := email[:strings.LastIndex(email, "@")]; !strings.Contains(local, "+") {
+		ruleSets = append(ruleSets, MailboxRules{})
+	}
+
+	seen := map[string]bool{}
+	var variants []string
+	for _, rules := range ruleSets {
+		variant := canonicalMailbox(email, rules)
+		if !seen[variant] {
+			seen[variant] = true
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// canonicalEmail canonicalizes a parsed email with the rules of whichever of
+// domains it matches.
+func canonicalEmail(domains []DomainConfig, email string) string {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	config, _ := matchDomain(domains, domain)
+	return canonicalMailbox(email, config.mailboxRules(domain))
+}
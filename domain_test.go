@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := map[string]string{
+		"uvic.ca":           "uvic.ca",
+		" @UVic.CA ":        "uvic.ca",
+		"*.UVic.ca":         "*.uvic.ca",
+		"Bücher.example":    "xn--bcher-kva.example",
+		"*.bücher.example.": "*.xn--bcher-kva.example",
+	}
+	for input, expected := range tests {
+		actual, err := normalizeDomain(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+
+	for _, input := range []string{"", "ca", "*.ca", "a b.com", "*"} {
+		if actual, err := normalizeDomain(input); err == nil {
+			t.Errorf("%q: expected an error, got %q", input, actual)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	domains := []DomainConfig{
+		{Domain: "*.uvic.ca", Role: 1},
+		{Domain: "uvic.ca", Role: 2},
+		{Domain: "*.engr.uvic.ca", Role: 3},
+		{Domain: "cs.uvic.ca", Role: 4},
+	}
+	tests := map[string]DomainConfig{
+		"uvic.ca":           domains[1],
+		"cs.uvic.ca":        domains[3],
+		"math.uvic.ca":      domains[0],
+		"mail.cs.uvic.ca":   domains[0],
+		"ece.engr.uvic.ca":  domains[2],
+		"engr.uvic.ca":      domains[0],
+		"notuvic.ca":        {},
+		"uvic.ca.evil.com":  {},
+		"xn--uvic-ca.other": {},
+	}
+	for domain, expected := range tests {
+		actual, ok := matchDomain(domains, domain)
+		if ok != (expected != DomainConfig{}) || actual != expected {
+			t.Errorf("%q: expected %v, got %v (ok: %v)", domain, expected, actual, ok)
+		}
+	}
+}
+
+func TestCanonicalMailbox(t *testing.T) {
+	tests := []struct {
+		email    string
+		rules    MailboxRules
+		expected string
+	}{
+		{"first.last+tag@gmail.com", builtinMailboxRules["gmail.com"], "firstlast@gmail.com"},
+		{"firstlast@gmail.com", builtinMailboxRules["gmail.com"], "firstlast@gmail.com"},
+		{"first.last+tag@uvic.ca", MailboxRules{}, "first.last+tag@uvic.ca"},
+		{"first-tag+other@example.com", MailboxRules{TagSeparators: "+-"}, "first@example.com"},
+		{"+tag@example.com", MailboxRules{TagSeparators: "+"}, "+tag@example.com"},
+	}
+	for _, test := range tests {
+		actual := canonicalMailbox(test.email, test.rules)
+		if actual != test.expected {
+			t.Errorf("%q with %+v: expected %q, got %q", test.email, test.rules, test.expected, actual)
+		}
+	}
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	domains := []DomainConfig{
+		{Domain: "gmail.com", Role: 1},
+		{Domain: "uvic.ca", Role: 2, Rules: &MailboxRules{TagSeparators: "+"}},
+	}
+	tests := map[string]string{
+		"first.last+spam@gmail.com": "firstlast@gmail.com",
+		"some.one+tag@uvic.ca":      "some.one@uvic.ca",
+		"some.one+tag@example.com":  "some.one+tag@example.com",
+	}
+	for email, expected := range tests {
+		actual := canonicalEmail(domains, email)
+		if actual != expected {
+			t.Errorf("%q: expected %q, got %q", email, expected, actual)
+		}
+	}
+}
+
+func TestMailboxVariants(t *testing.T) {
+	tests := []struct {
+		config   DomainConfig
+		email    string
+		expected []string
+	}{
+		// without rules, addresses that differ by a dot are different people
+		{DomainConfig{Domain: "school.edu"}, "j.smith@school.edu", []string{"j.smith@school.edu"}},
+		{DomainConfig{Domain: "*.school.edu"}, "j.smith-x@cs.school.edu", []string{"j.smith-x@cs.school.edu"}},
+		// the built-in rules, and none before those
+		{DomainConfig{Domain: "gmail.com"}, "first.last@gmail.com", []string{"firstlast@gmail.com", "first.last@gmail.com"}},
+		// addresses with a + couldn't be verified before there were rules
+		{DomainConfig{Domain: "gmail.com"}, "first.last+tag@gmail.com", []string{"firstlast@gmail.com"}},
+		// admins' rules, then the built-in ones
+		{DomainConfig{Domain: "gmail.com", Rules: &MailboxRules{TagSeparators: "+"}}, "first.last@gmail.com", []string{"first.last@gmail.com", "firstlast@gmail.com"}},
+		{DomainConfig{Domain: "school.edu", Rules: &MailboxRules{IgnoreDots: true}}, "j.smith@school.edu", []string{"jsmith@school.edu", "j.smith@school.edu"}},
+	}
+	for _, test := range tests {
+		variants := mailboxVariants(test.config, test.email)
+		if !reflect.DeepEqual(variants, test.expected) {
+			t.Errorf("%q with %+v: expected %q, got %q", test.email, test.config, test.expected, variants)
+		}
+	}
+}
+
+func TestAllowsPlus(t *testing.T) {
+	tests := []struct {
+		config   DomainConfig
+		domain   string
+		expected bool
+	}{
+		// the + is ignored
+		{DomainConfig{Domain: "gmail.com"}, "gmail.com", true},
+		// there's no rule for it, so it's taken to be an alias
+		{DomainConfig{Domain: "uvic.ca"}, "uvic.ca", false},
+		{DomainConfig{Domain: "yahoo.com"}, "yahoo.com", false},
+		// admins said the addresses are exact
+		{DomainConfig{Domain: "uvic.ca", Rules: &MailboxRules{}}, "uvic.ca", true},
+	}
+	for _, test := range tests {
+		if actual := test.config.allowsPlus(test.domain); actual != test.expected {
+			t.Errorf("%s with %+v: expected %v, got %v", test.domain, test.config.Rules, test.expected, actual)
+		}
+	}
+}
@@ -1,66 +1,83 @@
 package main
 
 import (
-	"crypto/tls"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"net/mail"
 	"strings"
-
-	"gopkg.in/gomail.v2"
 )
 
-const smtpHost = "smtp.gmail.com"
-const smtpPort = 587
-
-var botEmail = mustEnv("GMAIL_EMAIL")
-var botPassword = mustEnv("GMAIL_PASSWORD")
-
-var emailDialer = gomail.NewDialer(smtpHost, smtpPort, botEmail, botPassword)
-
-func SendEmail(to, subject, body string) error {
-	emailDialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	m := gomail.NewMessage()
-	m.SetAddressHeader("From", botEmail, "Gatekeeper")
-	m.SetAddressHeader("To", to, "")
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", emailifyNewlines(body))
-
-	return emailDialer.DialAndSend(m)
-}
-
 func emailifyNewlines(in string) string {
 	return strings.ReplaceAll(in, "\n", "\r\n")
 }
 
-func validateEmail(domain, email string) error {
+func extractDomain(email string) (string, error) {
 	address, err := mail.ParseAddress(email)
 	if err != nil {
-		return fmt.Errorf("email address format is invalid")
-	}
-
-	// is it the correct email domain?
-	if !strings.HasSuffix(address.Address, "@"+domain) {
-		return fmt.Errorf("email address must be a valid %s domain email address", domain)
+		return "", fmt.Errorf("email address format is invalid")
 	}
 
-	// is it not an alias email address?
-	if strings.Contains(address.Address, "+") {
-		return fmt.Errorf("email address must not be an alias")
+	parts := strings.Split(address.Address, "@")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("email address format is invalid")
 	}
 
-	return nil
+	return parts[1], nil
 }
 
-func extractDomain(email string) (string, error) {
-	address, err := mail.ParseAddress(email)
+// parseEmail returns the address out of email, which can be anything
+// net/mail understands, lowercased and with the domain in ASCII. Identifiers
+// are made from this, so the same address always gets the same identifier.
+func parseEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
 	if err != nil {
 		return "", fmt.Errorf("email address format is invalid")
 	}
-
-	parts := strings.Split(address.Address, "@")
-	if len(parts) != 2 {
+	at := strings.LastIndex(address.Address, "@")
+	if at < 0 {
 		return "", fmt.Errorf("email address format is invalid")
 	}
+	domain, err := canonicalDomain(address.Address[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("email address format is invalid")
+	}
+	return strings.ToLower(address.Address[:at]) + "@" + domain, nil
+}
 
-	return parts[1], nil
+// parseEmailList reads email addresses from a text file with one per line or a
+// CSV file. Fields without an @ are ignored so that headers and names can be
+// left in, and fields with an @ that aren't valid addresses are counted as
+// invalid. Duplicates are only returned once.
+func parseEmailList(r io.Reader) (emails []string, invalid int, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	seen := map[string]bool{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		for _, field := range record {
+			if !strings.Contains(field, "@") {
+				continue
+			}
+			email, err := parseEmail(field)
+			if err != nil {
+				invalid++
+				continue
+			}
+			if !seen[email] {
+				seen[email] = true
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails, invalid, nil
 }
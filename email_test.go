@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEmailList(t *testing.T) {
+	list := `name,email
+Someone,Someone@Example.com
+"Last, First",first.last@example.com
+not an email
+	another@example.com
+someone@example.com
+bad@@example.com
+`
+	emails, invalid, err := parseEmailList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"someone@example.com", "first.last@example.com", "another@example.com"}
+	if !reflect.DeepEqual(emails, expected) {
+		t.Errorf("expected emails %v, got %v", expected, emails)
+	}
+	if invalid != 1 {
+		t.Errorf("expected 1 invalid email, got %v", invalid)
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	tests := map[string]string{
+		"Someone@Example.com":            "someone@example.com",
+		"Some One <someone@example.com>": "someone@example.com",
+		"someone@BÜCHER.example":         "someone@xn--bcher-kva.example",
+		"someone@xn--bcher-kva.example":  "someone@xn--bcher-kva.example",
+	}
+	for input, expected := range tests {
+		actual, err := parseEmail(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+}
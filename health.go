@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long readiness waits on the database before giving up on it
+	healthPingTimeout = 2 * time.Second
+	// how long a sent email or a passed check vouches for the mailer, before
+	// it has to be checked again
+	mailerCheckInterval = 10 * time.Minute
+)
+
+// Health reports whether the bot is alive and ready to handle interactions,
+// for Docker and Kubernetes to probe.
+type Health struct {
+	store Store
+	// gatewayAlive is nil when interactions come over HTTP, since the
+	// gateway isn't used then
+	gatewayAlive func() bool
+	shuttingDown atomic.Bool
+
+	mu            sync.Mutex
+	mailerErr     error
+	mailerChecked bool
+	// mailerKnownAt is when mailerErr was last found out, zero if it needs
+	// checking again
+	mailerKnownAt time.Time
+}
+
+func NewHealth(store Store, gatewayAlive func() bool) *Health {
+	return &Health{store: store, gatewayAlive: gatewayAlive}
+}
+
+// CheckMailer checks that emails could be sent, and remembers the result for
+// readiness. Checking can mean logging in to a mail server, so it's skipped
+// while emails are being sent fine, and otherwise done in the background
+// instead of on every probe.
+func (h *Health) CheckMailer(m Mailer) {
+	h.mu.Lock()
+	due := h.mailerErr != nil || time.Since(h.mailerKnownAt) >= mailerCheckInterval
+	h.mu.Unlock()
+	if !due {
+		return
+	}
+
+	err := m.Check()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil && h.mailerErr == nil {
+		slog.Error("mailer check failed", "err", err)
+	} else if err == nil && h.mailerErr != nil {
+		slog.Info("mailer check passed again")
+	}
+	h.mailerErr = err
+	h.mailerChecked = true
+	h.mailerKnownAt = time.Now()
+}
+
+// RecordSend remembers how sending an email went. A sent email shows that the
+// mailer works without checking it, but a failed one could just be a bad
+// address, so that only makes the next check go ahead.
+func (h *Health) RecordSend(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.mailerKnownAt = time.Time{}
+		return
+	}
+	if h.mailerErr != nil {
+		slog.Info("mailer is sending emails again")
+	}
+	h.mailerErr = nil
+	h.mailerChecked = true
+	h.mailerKnownAt = time.Now()
+}
+
+// ShutDown marks the bot as no longer ready, so that it stops being sent
+// work while it shuts down.
+func (h *Health) ShutDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Ready returns why the bot isn't ready, if it isn't.
+func (h *Health) Ready(ctx context.Context) []string {
+	if h.shuttingDown.Load() {
+		return []string{"shutting down"}
+	}
+
+	var problems []string
+	if h.gatewayAlive != nil && !h.gatewayAlive() {
+		problems = append(problems, "gateway isn't connected")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	if err := h.store.Ping(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("database: %v", err))
+	}
+
+	h.mu.Lock()
+	if !h.mailerChecked {
+		problems = append(problems, "mailer hasn't been checked yet")
+	} else if h.mailerErr != nil {
+		problems = append(problems, fmt.Sprintf("mailer: %v", h.mailerErr))
+	}
+	h.mu.Unlock()
+
+	return problems
+}
+
+// Handler serves /healthz, which only fails if the bot is stuck enough to not
+// answer, and /readyz, which fails with the reasons the bot isn't ready.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		problems := h.Ready(r.Context())
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+type checkMailer struct {
+	err error
+}
+
+func (m checkMailer) Send(e Email) error { return m.err }
+func (m checkMailer) Check() error       { return m.err }
+
+func TestHealth(t *testing.T) {
+	store := newTestStore(t)
+	var gatewayUp atomic.Bool
+	gatewayUp.Store(true)
+	health := NewHealth(store, gatewayUp.Load)
+
+	server := httptest.NewServer(health.Handler())
+	defer server.Close()
+
+	status := func(path string) int {
+		res, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	expectReady := func(ready bool) {
+		t.Helper()
+		expected := http.StatusServiceUnavailable
+		if ready {
+			expected = http.StatusOK
+		}
+		if code := status("/readyz"); code != expected {
+			t.Errorf("expected /readyz to be %v, got %v (problems: %v)", expected, code, health.Ready(context.Background()))
+		}
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to be 200, got %v", code)
+	}
+
+	// the mailer hasn't been checked yet
+	expectReady(false)
+
+	health.CheckMailer(checkMailer{})
+	expectReady(true)
+
+	// a passed check isn't repeated until an email fails
+	health.CheckMailer(checkMailer{err: errors.New("connection refused")})
+	expectReady(true)
+	health.RecordSend(errors.New("connection refused"))
+	health.CheckMailer(checkMailer{err: errors.New("connection refused")})
+	expectReady(false)
+	health.CheckMailer(checkMailer{})
+
+	gatewayUp.Store(false)
+	expectReady(false)
+	gatewayUp.Store(true)
+
+	store.Close()
+	expectReady(false)
+
+	health = NewHealth(newTestStore(t), nil)
+	health.CheckMailer(checkMailer{})
+	if problems := health.Ready(context.Background()); len(problems) > 0 {
+		t.Errorf("expected to be ready without a gateway, got %v", problems)
+	}
+	health.ShutDown()
+	if problems := health.Ready(context.Background()); len(problems) == 0 {
+		t.Error("expected not to be ready while shutting down")
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to stay 200 while shutting down, got %v", code)
+	}
+}
+
+type countingMailer struct {
+	checkMailer
+	checks int
+}
+
+func (m *countingMailer) Check() error {
+	m.checks++
+	return m.err
+}
+
+func TestHealthRecordSend(t *testing.T) {
+	health := NewHealth(newTestStore(t), nil)
+	m := &countingMailer{}
+
+	// a sent email vouches for the mailer, so it isn't checked
+	health.RecordSend(nil)
+	if problems := health.Ready(context.Background()); len(problems) > 0 {
+		t.Errorf("expected to be ready after sending an email, got %v", problems)
+	}
+	health.CheckMailer(m)
+	if m.checks != 0 {
+		t.Errorf("expected no checks after sending an email, got %v", m.checks)
+	}
+
+	// a failed email could be a bad address, so it only makes a check go ahead
+	health.RecordSend(errors.New("no such user"))
+	if problems := health.Ready(context.Background()); len(problems) > 0 {
+		t.Errorf("expected a failed email alone not to affect readiness, got %v", problems)
+	}
+	m.err = errors.New("connection refused")
+	health.CheckMailer(m)
+	if m.checks != 1 {
+		t.Errorf("expected a check after a failed email, got %v", m.checks)
+	}
+	if problems := health.Ready(context.Background()); len(problems) == 0 {
+		t.Error("expected not to be ready after the check failed")
+	}
+
+	// failed checks are retried every time
+	health.CheckMailer(m)
+	if m.checks != 2 {
+		t.Errorf("expected the failed check to be retried, got %v checks", m.checks)
+	}
+
+	health.RecordSend(nil)
+	if problems := health.Ready(context.Background()); len(problems) > 0 {
+		t.Errorf("expected a sent email to make it ready again, got %v", problems)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+const (
+	// interactions are small, this is just so a bad request can't use up memory
+	maxInteractionSize = 1 << 20
+	// requests signed further from now than this are refused, so that one
+	// that's been captured can't be replayed later
+	maxTimestampSkew = 5 * time.Second
+)
+
+// InteractionServer receives interactions from discord over HTTP instead of
+// the gateway. Requests are signed by discord with the application's key.
+// https://discord.com/developers/docs/interactions/receiving-and-responding#security-and-authorization
+type InteractionServer struct {
+	publicKey ed25519.PublicKey
+	handle    func(*gateway.InteractionCreateEvent) *api.InteractionResponse
+}
+
+func NewInteractionServer(s *state.State, commands []Command, publicKey ed25519.PublicKey) *InteractionServer {
+	return &InteractionServer{
+		publicKey: publicKey,
+		handle:    makeInteractionHandler(s, commands),
+	}
+}
+
+// ParsePublicKey parses the application public key, as shown in hex on the
+// developer portal.
+func ParsePublicKey(key string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("public key should be hex: %w", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key should be %v bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+func (i *InteractionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInteractionSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// discord checks that requests with bad signatures are rejected
+	if !i.verify(r.Header, body) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var e gateway.InteractionCreateEvent
+	if err := json.Unmarshal(body, &e.InteractionEvent); err != nil {
+		slog.Warn("error decoding interaction", "err", err)
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+	if err := rememberPermissions(body); err != nil {
+		slog.Warn("error decoding interaction", "err", err)
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	data := i.handle(&e)
+	if data == nil {
+		// no response
+		responded(e.ID, false)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		interactionLog(&e).Error("failed to send interaction response", "err", err)
+	}
+	// make sure discord has the response before any deferred work edits it
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	responded(e.ID, err == nil)
+}
+
+func (i *InteractionServer) verify(header http.Header, body []byte) bool {
+	signature, err := hex.DecodeString(header.Get("X-Signature-Ed25519"))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	timestamp := header.Get("X-Signature-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		return false
+	}
+	message := append([]byte(timestamp), body...)
+	return ed25519.Verify(i.publicKey, message, signature)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+func TestInteractionServer(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePublicKey(hex.EncodeToString(publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := []Command{{
+		Data: api.CreateCommandData{Name: "hello"},
+		Handler: func(s *state.State, e *gateway.InteractionCreateEvent, options discord.CommandInteractionOptions) *api.InteractionResponse {
+			return makeEphemeralResponse("hello " + e.SenderID().String())
+		},
+	}}
+	server := httptest.NewServer(NewInteractionServer(nil, commands, parsed))
+	defer server.Close()
+
+	sendAt := func(body string, key ed25519.PrivateKey, at time.Time) *http.Response {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		signature := ed25519.Sign(key, []byte(timestamp+body))
+		req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(signature))
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	send := func(body string, key ed25519.PrivateKey) *http.Response {
+		return sendAt(body, key, time.Now())
+	}
+	decode := func(res *http.Response) api.InteractionResponse {
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %v", res.StatusCode)
+		}
+		var data api.InteractionResponse
+		if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	ping := `{"id":"1","application_id":"2","type":1,"token":"token","version":1}`
+	if data := decode(send(ping, privateKey)); data.Type != api.PongInteraction {
+		t.Errorf("expected pong, got %v", data.Type)
+	}
+
+	command := `{"id":"1","application_id":"2","type":2,"guild_id":"3","token":"token","version":1,` +
+		`"member":{"user":{"id":"4","username":"someone"}},"data":{"id":"5","name":"hello","type":1}}`
+	data := decode(send(command, privateKey))
+	if data.Type != api.MessageInteractionWithSource || data.Data == nil || data.Data.Content.Val != "hello 4" {
+		t.Errorf("unexpected response %+v", data)
+	}
+
+	// signed by someone else
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := send(ping, otherKey)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a bad signature, got %v", res.StatusCode)
+	}
+
+	// signed too long ago, like a captured request being replayed
+	res = sendAt(ping, privateKey, time.Now().Add(-time.Minute))
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for an old timestamp, got %v", res.StatusCode)
+	}
+
+	// not signed
+	res, err = http.Post(server.URL, "application/json", bytes.NewBufferString(ping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a signature, got %v", res.StatusCode)
+	}
+
+	if _, err := ParsePublicKey("not hex"); err == nil {
+		t.Error("expected an error for an invalid public key")
+	}
+}
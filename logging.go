@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// redacted replaces anything that shouldn't be logged
+const redacted = "[redacted]"
+
+var (
+	// loose on purpose, it's better to redact too much than too little. / is
+	// left out so that discord's @original URLs aren't mistaken for emails
+	emailPattern = regexp.MustCompile(`[^\s@<>()\[\]{}"'/,;:]+@[^\s@<>()\[\]{}"'/,;:]+`)
+	// verification tokens, as printed by Token.String
+	tokenPattern = regexp.MustCompile(`\b[0-9A-V]{13}\b`)
+	// interaction tokens end up in the URLs of API errors
+	interactionTokenPattern = regexp.MustCompile(`(/(?:webhooks|interactions)/\d+/)[^/\s?"]+`)
+)
+
+// redact removes email addresses and tokens from s.
+func redact(s string) string {
+	s = emailPattern.ReplaceAllString(s, redacted)
+	s = interactionTokenPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = tokenPattern.ReplaceAllStringFunc(s, func(match string) string {
+		// all digits is more likely a number than a token
+		if strings.Trim(match, "0123456789") == "" {
+			return match
+		}
+		return redacted
+	})
+	return s
+}
+
+// sensitiveKey is whether a field should never be logged, whatever its value.
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "email" || key == "to" || strings.Contains(key, "token") || strings.Contains(key, "password")
+}
+
+// redactHandler redacts the message and fields of every record before passing
+// it on, so that nothing logged anywhere can leak an email or a token.
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return redactHandler{h.Handler.WithAttrs(redactedAttrs)}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		attrs := make([]any, len(group))
+		for i, ga := range group {
+			attrs[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny:
+		// errors and anything else can say anything, so they're logged as
+		// redacted text
+		switch value := v.Any().(type) {
+		case []string:
+			strs := make([]string, len(value))
+			for i, s := range value {
+				strs[i] = redact(s)
+			}
+			return slog.Any(a.Key, strs)
+		case error:
+			return slog.String(a.Key, redact(value.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, redact(value.String()))
+		default:
+			return slog.String(a.Key, redact(fmt.Sprint(value)))
+		}
+	default:
+		return slog.Attr{Key: a.Key, Value: v}
+	}
+}
+
+// LogValue keeps tokens out of the logs even when they're logged on purpose.
+func (t Token) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// newLogger makes a logger writing to w, in JSON unless format is "text".
+func newLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("$LOG_FORMAT should be json or text, got %q", format)
+	}
+	return slog.New(redactHandler{handler}), nil
+}
+
+// SetupLogging makes the logger configured by $LOG_FORMAT and $LOG_LEVEL the
+// default, which the log package writes through too.
+func SetupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOr("LOG_LEVEL", "info"))); err != nil {
+		return fmt.Errorf("invalid $LOG_LEVEL: %w", err)
+	}
+	logger, err := newLogger(os.Stderr, envOr("LOG_FORMAT", "json"), level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// fatal logs an error and exits, for errors the bot can't start with.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// interactionLog is the logger for everything to do with an interaction.
+func interactionLog(e *gateway.InteractionCreateEvent) *slog.Logger {
+	logger := slog.With(
+		"interaction", e.ID,
+		"guild", e.GuildID,
+		"user", e.SenderID(),
+	)
+	if cmd, ok := e.Data.(*discord.CommandInteraction); ok {
+		logger = logger.With("command", cmd.Name)
+	}
+	return logger
+}
+
+// latency is how long since start, in milliseconds, for logging.
+func latency(start time.Time) slog.Attr {
+	return slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+func TestRedact(t *testing.T) {
+	token := MakeToken()
+	tests := []struct {
+		in, expected string
+	}{
+		{"error parsing someone@example.com", "error parsing " + redacted},
+		{"<First.Last+tag@uvic.ca>", "<" + redacted + ">"},
+		{"token " + token.String() + " expired", "token " + redacted + " expired"},
+		{"PATCH https://discord.com/api/v10/webhooks/123/aW50ZXJhY3Rpb246dG9rZW4/messages/@original: 404",
+			"PATCH https://discord.com/api/v10/webhooks/123/" + redacted + "/messages/@original: 404"},
+		{"POST https://discord.com/api/v10/interactions/456/aW50ZXJhY3Rpb24/callback",
+			"POST https://discord.com/api/v10/interactions/456/" + redacted + "/callback"},
+		// snowflakes and other numbers are left alone
+		{"guild 1234567890123 user 987654321987654321", "guild 1234567890123 user 987654321987654321"},
+	}
+	for _, test := range tests {
+		if actual := redact(test.in); actual != test.expected {
+			t.Errorf("redact(%q): expected %q, got %q", test.in, test.expected, actual)
+		}
+	}
+}
+
+func TestLoggerRedacts(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := MakeToken()
+
+	logger.With("guild", discord.GuildID(1)).Info("sending to someone@example.com",
+		"err", errors.New("550 no such user someone@example.com"),
+		"to", "someone@example.com",
+		"token", token,
+		"verification", token,
+		"group", slog.Group("inner", "address", "someone@example.com"),
+		"domains", []string{"example.com", "someone@example.com"},
+	)
+	logger.Debug("hidden")
+
+	out := buf.String()
+	if strings.Contains(out, "someone@example.com") || strings.Contains(out, token.String()) {
+		t.Errorf("expected emails and tokens to be redacted, got %s", out)
+	}
+	if strings.Contains(out, "hidden") {
+		t.Error("expected debug logs to be left out at info level")
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["guild"] != "1" || record["msg"] != "sending to "+redacted {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	if _, err := newLogger(buf, "xml", slog.LevelInfo); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Email is a message to a single recipient.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+	// HTML is optional, and sent as an alternative to the plain text Body
+	HTML string
+}
+
+// Mailer sends emails. Which one the bot uses is picked by $MAIL_BACKEND.
+type Mailer interface {
+	Send(e Email) error
+	// Check makes sure emails could be sent, without sending one.
+	Check() error
+}
+
+var mailer Mailer
+
+// NewMailerFromEnv sets up the mailer chosen by $MAIL_BACKEND, which is one of
+// "smtp" (the default), "sendmail" or "file".
+func NewMailerFromEnv() (Mailer, error) {
+	backend := envOr("MAIL_BACKEND", "smtp")
+	switch backend {
+	case "smtp":
+		config, err := smtpConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewSMTPMailer(config)
+	case "sendmail":
+		return NewSendmailMailer(envOr("SENDMAIL_PATH", "/usr/sbin/sendmail"), envOr("MAIL_FROM", "gatekeeper@localhost")), nil
+	case "file":
+		return NewFileMailer(envOr("MAIL_DIR", "mail"), envOr("MAIL_FROM", "gatekeeper@localhost"))
+	default:
+		return nil, fmt.Errorf("unknown $MAIL_BACKEND %q, expected smtp, sendmail or file", backend)
+	}
+}
+
+func newMessage(from string, e Email) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetAddressHeader("From", from, "Gatekeeper")
+	m.SetAddressHeader("To", e.To, "")
+	m.SetHeader("Subject", e.Subject)
+	m.SetDateHeader("Date", time.Now())
+	m.SetBody("text/plain", emailifyNewlines(e.Body))
+	if e.HTML != "" {
+		m.AddAlternative("text/html", emailifyNewlines(e.HTML))
+	}
+	return m
+}
+
+// SMTPTLSMode is how the connection to the SMTP server is encrypted.
+type SMTPTLSMode string
+
+const (
+	// SMTPStartTLS upgrades a plain connection, usually on port 587. Servers
+	// that don't support STARTTLS are refused rather than used unencrypted.
+	SMTPStartTLS SMTPTLSMode = "starttls"
+	// SMTPImplicitTLS uses TLS from the start, usually on port 465.
+	SMTPImplicitTLS SMTPTLSMode = "implicit"
+	// SMTPNoTLS is for local servers like MailHog.
+	SMTPNoTLS SMTPTLSMode = "none"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLS      SMTPTLSMode
+	// CAFile is a PEM bundle to verify the server with instead of the system's
+	// certificates
+	CAFile        string
+	MinTLSVersion uint16
+}
+
+func smtpConfigFromEnv() (SMTPConfig, error) {
+	port, err := strconv.Atoi(envOr("SMTP_PORT", "587"))
+	if err != nil {
+		return SMTPConfig{}, fmt.Errorf("invalid $SMTP_PORT: %w", err)
+	}
+
+	// port 465 is the standard port for implicit TLS
+	defaultMode := SMTPStartTLS
+	if port == 465 {
+		defaultMode = SMTPImplicitTLS
+	}
+
+	minVersion, err := parseTLSVersion(envOr("SMTP_TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return SMTPConfig{}, fmt.Errorf("invalid $SMTP_TLS_MIN_VERSION: %w", err)
+	}
+
+	// GMAIL_* are from before other SMTP servers were supported
+	username := envOr("SMTP_USERNAME", os.Getenv("GMAIL_EMAIL"))
+	return SMTPConfig{
+		Host:          envOr("SMTP_HOST", "smtp.gmail.com"),
+		Port:          port,
+		Username:      username,
+		Password:      envOr("SMTP_PASSWORD", os.Getenv("GMAIL_PASSWORD")),
+		From:          envOr("MAIL_FROM", username),
+		TLS:           SMTPTLSMode(envOr("SMTP_TLS", string(defaultMode))),
+		CAFile:        os.Getenv("SMTP_CA_FILE"),
+		MinTLSVersion: minVersion,
+	}, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+}
+
+// SMTPMailer sends email through an SMTP server, like Gmail or MailHog.
+type SMTPMailer struct {
+	addr      string
+	host      string
+	from      string
+	mode      SMTPTLSMode
+	tlsConfig *tls.Config
+	auth      smtp.Auth
+	// timeout is how long sending an email can take altogether
+	timeout time.Duration
+}
+
+// a stalled mail server mustn't hold an email past outboxLease, or another
+// worker would send it again
+const (
+	smtpDialTimeout = 10 * time.Second
+	smtpTimeout     = time.Minute
+)
+
+// NewSMTPMailer checks the config up front, so that a mistake stops the bot
+// from starting instead of quietly sending tokens without encryption.
+func NewSMTPMailer(config SMTPConfig) (*SMTPMailer, error) {
+	if config.From == "" {
+		return nil, fmt.Errorf("$MAIL_FROM is required when SMTP has no username")
+	}
+
+	switch config.TLS {
+	case SMTPStartTLS:
+		if config.Port == 465 {
+			return nil, fmt.Errorf("port 465 expects implicit TLS, not STARTTLS")
+		}
+	case SMTPImplicitTLS:
+	case SMTPNoTLS:
+		if config.Username != "" {
+			return nil, fmt.Errorf("refusing to send SMTP credentials without TLS")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q, expected starttls, implicit or none", config.TLS)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.Host,
+		MinVersion: config.MinTLSVersion,
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	m := &SMTPMailer{
+		addr:      net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		host:      config.Host,
+		from:      config.From,
+		mode:      config.TLS,
+		tlsConfig: tlsConfig,
+		timeout:   smtpTimeout,
+	}
+	if config.Username != "" {
+		m.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(e Email) error {
+	return gomail.Send(gomail.SendFunc(m.send), newMessage(m.from, e))
+}
+
+func (m *SMTPMailer) send(from string, to []string, msg io.WriterTo) error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if m.auth != nil {
+		err = c.Auth(m.auth)
+		if err != nil {
+			return fmt.Errorf("error authenticating with SMTP server: %w", err)
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = msg.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Check connects and logs in to the SMTP server.
+func (m *SMTPMailer) Check() error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if m.auth != nil {
+		err = c.Auth(m.auth)
+		if err != nil {
+			return fmt.Errorf("error authenticating with SMTP server: %w", err)
+		}
+	}
+	return c.Quit()
+}
+
+// dial connects to the SMTP server, failing if it can't be encrypted the way
+// it's configured to be.
+func (m *SMTPMailer) dial() (*smtp.Client, error) {
+	deadline := time.Now().Add(m.timeout)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout, Deadline: deadline}
+
+	var conn net.Conn
+	var err error
+	if m.mode == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, m.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	// covers everything said on the connection, not just connecting
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+
+	if m.mode == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("SMTP server %s doesn't support STARTTLS", m.addr)
+		}
+		err = c.StartTLS(m.tlsConfig)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error starting TLS with SMTP server: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// SendmailMailer pipes email to a local sendmail compatible program.
+type SendmailMailer struct {
+	path string
+	from string
+}
+
+func NewSendmailMailer(path, from string) *SendmailMailer {
+	return &SendmailMailer{path: path, from: from}
+}
+
+func (m *SendmailMailer) Send(e Email) error {
+	sendmail := gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		// -i stops a line with a single . from ending the message early
+		args := append([]string{"-i", "-f", from, "--"}, to...)
+		cmd := exec.Command(m.path, args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("error starting sendmail: %w", err)
+		}
+
+		_, err = msg.WriteTo(stdin)
+		closeErr := stdin.Close()
+		waitErr := cmd.Wait()
+		if err != nil {
+			return fmt.Errorf("error writing to sendmail: %w", err)
+		}
+		if closeErr != nil {
+			return fmt.Errorf("error writing to sendmail: %w", closeErr)
+		}
+		if waitErr != nil {
+			return fmt.Errorf("sendmail failed: %w", waitErr)
+		}
+		return nil
+	})
+	return gomail.Send(sendmail, newMessage(m.from, e))
+}
+
+// Check makes sure sendmail exists and can be run.
+func (m *SendmailMailer) Check() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return fmt.Errorf("error finding sendmail: %w", err)
+	}
+	if info.IsDir() || info.Mode()&0o111 == 0 {
+		return fmt.Errorf("sendmail at %s isn't executable", m.path)
+	}
+	return nil
+}
+
+// FileMailer writes each email to a .eml file instead of sending it, for
+// development and tests. Since the files contain tokens, don't use it for a
+// real server.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating mail directory: %w", err)
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(e Email) error {
+	drop := gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		var suffix [4]byte
+		rand.Read(suffix[:])
+		name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix[:]))
+
+		f, err := os.OpenFile(filepath.Join(m.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = msg.WriteTo(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	return gomail.Send(drop, newMessage(m.from, e))
+}
+
+// Check makes sure the mail directory still exists.
+func (m *FileMailer) Check() error {
+	info, err := os.Stat(m.dir)
+	if err != nil {
+		return fmt.Errorf("error finding mail directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("mail directory %s isn't a directory", m.dir)
+	}
+	return nil
+}
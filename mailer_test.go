@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MAIL_BACKEND", "file")
+	t.Setenv("MAIL_DIR", dir)
+	t.Setenv("MAIL_FROM", "gatekeeper@example.com")
+
+	m, err := NewMailerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send(Email{To: "someone@example.com", Subject: "Gatekeeper verification", Body: "hello\nthere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 email, got %v", len(files))
+	}
+
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(b)
+	for _, expected := range []string{
+		"From: \"Gatekeeper\" <gatekeeper@example.com>",
+		"To: someone@example.com",
+		"Subject: Gatekeeper verification",
+		"hello\r\nthere",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("expected email to contain %q, got:\n%s", expected, msg)
+		}
+	}
+}
+
+func TestNewMailerFromEnvUnknownBackend(t *testing.T) {
+	t.Setenv("MAIL_BACKEND", "pigeon")
+
+	_, err := NewMailerFromEnv()
+	if err == nil {
+		t.Error("expected an unknown backend to fail")
+	}
+}
+
+func TestNewSMTPMailerMisconfigured(t *testing.T) {
+	emptyCA := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(emptyCA, []byte("not a certificate"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := SMTPConfig{
+		Host:          "smtp.example.com",
+		Port:          587,
+		Username:      "gatekeeper@example.com",
+		Password:      "hunter2",
+		From:          "gatekeeper@example.com",
+		TLS:           SMTPStartTLS,
+		MinTLSVersion: tls.VersionTLS12,
+	}
+	_, err = NewSMTPMailer(valid)
+	if err != nil {
+		t.Fatalf("expected valid config to work, got %v", err)
+	}
+
+	tests := map[string]func(c *SMTPConfig){
+		"unknown mode":            func(c *SMTPConfig) { c.TLS = "maybe" },
+		"STARTTLS on 465":         func(c *SMTPConfig) { c.Port = 465 },
+		"credentials without TLS": func(c *SMTPConfig) { c.TLS = SMTPNoTLS },
+		"missing CA file":         func(c *SMTPConfig) { c.CAFile = filepath.Join(t.TempDir(), "missing.pem") },
+		"CA file without certs":   func(c *SMTPConfig) { c.CAFile = emptyCA },
+		"no sender":               func(c *SMTPConfig) { c.From = "" },
+	}
+	for name, misconfigure := range tests {
+		config := valid
+		misconfigure(&config)
+		_, err := NewSMTPMailer(config)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	t.Setenv("SMTP_TLS_MIN_VERSION", "1.4")
+	_, err = NewMailerFromEnv()
+	if err == nil {
+		t.Error("expected an unknown TLS version to fail")
+	}
+}
+
+func TestSMTPMailerTimesOut(t *testing.T) {
+	// a server that accepts connections but never says anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := &SMTPMailer{
+		addr:    l.Addr().String(),
+		host:    "127.0.0.1",
+		from:    "gatekeeper@example.com",
+		mode:    SMTPNoTLS,
+		timeout: 100 * time.Millisecond,
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.Send(Email{To: "someone@example.com", Subject: "hi", Body: "hi"}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected sending to a stalled server to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending to a stalled server didn't time out")
+	}
+}
@@ -2,31 +2,55 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/diamondburned/arikawa/v3/api"
 	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/gateway"
 	"github.com/diamondburned/arikawa/v3/state"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-func init() {
-	var err error
+func main() {
+	err := SetupLogging()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	db, err = InitDB()
 	if err != nil {
-		log.Fatalln(err)
+		fatal("error opening database", "err", err)
+	}
+
+	pepper, err = LoadPepper()
+	if err != nil {
+		fatal("error loading pepper", "err", err)
+	}
+	if pepper == nil {
+		// identifiers made with a pepper can't be recognized without it, so
+		// carrying on would let banned emails verify again
+		peppered, err := db.HasPepperedIdentifiers()
+		if err != nil {
+			fatal("error checking for peppered identifiers", "err", err)
+		}
+		if peppered {
+			fatal("$IDENTIFIER_PEPPER isn't set, but the database has identifiers that were made with one")
+		}
+		slog.Warn("no $IDENTIFIER_PEPPER is set, so a copy of the database is enough to guess which emails were verified")
+	}
+
+	mailer, err = NewMailerFromEnv()
+	if err != nil {
+		fatal("error setting up mailer", "err", err)
 	}
-}
 
-func main() {
 	appID := discord.AppID(mustSnowflakeEnv("APP_ID"))
 	token := mustEnv("DISCORD_TOKEN")
 
@@ -34,27 +58,107 @@ func main() {
 	s := state.New("Bot " + token)
 	s.AddIntents(gateway.IntentGuilds)
 
-	s.AddHandler(MakeCommandHandlers(s, commandsGlobal))
-
-	// executed when either you join a guild or when the bot starts
-	// https://discord.com/developers/docs/topics/gateway#guilds
-	s.AddHandler(func(e *gateway.GuildCreateEvent) {
-		// TODO add a better option for whether to clobber old commands
-		guild := e.Guild.ID
-		if _, ok := os.LookupEnv("CLOBBER_CMDS"); ok {
-			cmds, err := s.Commands(appID)
-			if err != nil {
-				log.Println("error getting commands:", err)
+	// the gateway isn't used when interactions come over HTTP
+	var gatewayAlive func() bool
+	if os.Getenv("INTERACTIONS_ADDR") == "" {
+		gatewayAlive = s.GatewayIsAlive
+	}
+	health := NewHealth(db, gatewayAlive)
+	var healthServer *http.Server
+	if addr := os.Getenv("HEALTH_ADDR"); addr != "" {
+		healthServer = &http.Server{
+			Addr:              addr,
+			Handler:           health.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			err := healthServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal("health server failed", "err", err)
 			}
-			removeCommands(s, guild, cmds)
+		}()
+		slog.Info("serving health checks", "addr", addr)
+	}
+
+	// the outbox has to be running before any interaction can come in, since
+	// /register queues emails in it
+	workers, err := strconv.Atoi(envOr("MAIL_WORKERS", "2"))
+	if err != nil || workers < 1 {
+		fatal("invalid $MAIL_WORKERS", "value", os.Getenv("MAIL_WORKERS"))
+	}
+	outbox = NewOutbox(s, health)
+	outbox.Start(workers)
+
+	global, err := globalCommandsFromEnv()
+	if err != nil {
+		fatal("invalid command scope", "err", err)
+	}
+	// commands are registered either globally or in each guild, and cleared
+	// from the other in case they were registered there before
+	globalCommands, guildCommands := []Command(nil), commandsGlobal
+	if global {
+		globalCommands, guildCommands = commandsGlobal, nil
+	}
+	syncAndLog(s, appID, 0, globalCommands)
+
+	// interactions come over HTTP if there's an address for them, otherwise
+	// over the gateway
+	var server *http.Server
+	if addr := os.Getenv("INTERACTIONS_ADDR"); addr != "" {
+		publicKey, err := ParsePublicKey(mustEnv("DISCORD_PUBLIC_KEY"))
+		if err != nil {
+			fatal("invalid $DISCORD_PUBLIC_KEY", "err", err)
 		}
-		registerCommands(s, appID, guild)
-	})
+		// without the gateway there's no event for each guild, so sync them
+		// all now
+		guilds, err := guildIDs(s)
+		if err != nil {
+			fatal("error listing guilds", "err", err)
+		}
+		for _, guild := range guilds {
+			syncAndLog(s, appID, guild, guildCommands)
+		}
+		server = &http.Server{
+			Addr:              addr,
+			Handler:           NewInteractionServer(s, commandsGlobal, publicKey),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			err := server.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal("interaction server failed", "err", err)
+			}
+		}()
+		slog.Info("listening for interactions", "addr", addr)
+	} else {
+		s.AddHandler(MakeCommandHandlers(s, commandsGlobal))
 
-	if err := s.Open(context.Background()); err != nil {
-		log.Fatalln("failed to open:", err)
+		// executed when either you join a guild or when the bot starts
+		// https://discord.com/developers/docs/topics/gateway#guilds
+		s.AddHandler(func(e *gateway.GuildCreateEvent) {
+			syncAndLog(s, appID, e.Guild.ID, guildCommands)
+		})
+
+		if err := s.Open(context.Background()); err != nil {
+			fatal("failed to open", "err", err)
+		}
+	}
+
+	var metricsServer *http.Server
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsServer = &http.Server{
+			Addr:              addr,
+			Handler:           NewMetricsHandler(db),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal("metrics server failed", "err", err)
+			}
+		}()
+		slog.Info("serving metrics", "addr", addr)
 	}
-	defer s.Close()
 
 	// setup cleanup channel for ctrl+c
 	// closing this unblocks
@@ -69,26 +173,48 @@ func main() {
 		close(cleanup)
 	}()
 
-	// setup ticker for cleaning tokens
+	// setup ticker for cleaning up expired rows and bans
 	ticker := time.NewTicker(5 * time.Minute)
 	cleanupWaitGroup.Add(1)
 	go func() {
 		for {
 			select {
 			case <-cleanup:
-				db.CleanupTokens()
+				cleanupDB()
 				cleanupWaitGroup.Done()
 				return
 			case <-ticker.C:
-				db.CleanupTokens()
+				cleanupDB()
+				purgeExpiredBans(s)
 			}
 		}
 	}()
 
+	// keep checking that emails can be sent, for readiness. Most checks are
+	// skipped while emails are being sent
+	if healthServer != nil {
+		cleanupWaitGroup.Add(1)
+		go func() {
+			defer cleanupWaitGroup.Done()
+			mailerTicker := time.NewTicker(time.Minute)
+			defer mailerTicker.Stop()
+			for {
+				health.CheckMailer(mailer)
+				select {
+				case <-cleanup:
+					return
+				case <-mailerTicker.C:
+				}
+			}
+		}()
+	}
+
 	// block until ctrl+c or kill
-	log.Println("bot is running")
+	slog.Info("bot is running")
 	<-cleanup
-	log.Println("cleaning up")
+	slog.Info("cleaning up")
+	// stop being sent work before anything is torn down
+	health.ShutDown()
 	ticker.Stop()
 
 	// cleanupWaitGroup.Add(1)
@@ -98,62 +224,97 @@ func main() {
 	// 	cleanupWaitGroup.Done()
 	// }()
 
-	cleanupWaitGroup.Add(1)
-	go func() {
-		err := db.db.Close()
+	// stop taking interactions, letting the ones in progress finish
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = server.Shutdown(ctx)
+		cancel()
 		if err != nil {
-			log.Println("error closing db:", err)
+			slog.Error("error shutting down interaction server", "err", err)
 		}
-		cleanupWaitGroup.Done()
-	}()
-
-	cleanupWaitGroup.Wait()
-	log.Println("exiting")
-}
+	} else {
+		err = s.Close()
+		if err != nil {
+			slog.Error("error closing gateway", "err", err)
+		}
+	}
+	// deferred work like /register can still be queueing emails
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = waitInFlight(ctx)
+	cancel()
+	if err != nil {
+		slog.Error("error waiting for interactions to finish", "err", err)
+	}
 
-func registerCommands(s *state.State, appID discord.AppID, guildID discord.GuildID) error {
-	// extract command definitions from command global variable
-	definitions := make([]api.CreateCommandData, 0, len(commandsGlobal))
-	for _, v := range commandsGlobal {
-		definitions = append(definitions, v.Data)
+	// send the emails that are due while the db is still around
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	err = outbox.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		slog.Error("error draining outbox", "err", err)
 	}
 
-	// register command definitions with discord
-	for _, command := range definitions {
-		_, err := s.CreateGuildCommand(appID, guildID, command)
+	cleanupWaitGroup.Wait()
+
+	if metricsServer != nil {
+		err = metricsServer.Close()
 		if err != nil {
-			return fmt.Errorf("failed to create guild command: %w", err)
+			slog.Error("error closing metrics server", "err", err)
 		}
 	}
 
-	return nil
-}
+	err = db.Close()
+	if err != nil {
+		slog.Error("error closing db", "err", err)
+	}
 
-func removeCommands(s *state.State, guild discord.GuildID, activeCommands []discord.Command) {
-	for _, cmd := range activeCommands {
-		// only remove commands from current guild
-		if cmd.GuildID != guild {
-			continue
-		}
-		err := s.DeleteGuildCommand(cmd.AppID, guild, cmd.ID)
+	if healthServer != nil {
+		err = healthServer.Close()
 		if err != nil {
-			log.Println("couldn't delete command", cmd.Name, "with id", cmd)
+			slog.Error("error closing health server", "err", err)
 		}
 	}
+	slog.Info("exiting")
+}
+
+func cleanupDB() {
+	err := db.CleanupTokens()
+	if err != nil {
+		slog.Error("error cleaning up tokens", "err", err)
+	}
+	err = db.CleanupVerifyFailures(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		slog.Error("error cleaning up failed verifications", "err", err)
+	}
+	err = db.CleanupEmailSends(time.Now().Add(-maxRateLimitWindow))
+	if err != nil {
+		slog.Error("error cleaning up sent emails", "err", err)
+	}
+	err = db.CleanupOutbox(time.Now().Add(-7 * 24 * time.Hour))
+	if err != nil {
+		slog.Error("error cleaning up outbox", "err", err)
+	}
 }
 
 func mustSnowflakeEnv(env string) discord.Snowflake {
 	s, err := discord.ParseSnowflake(os.Getenv(env))
 	if err != nil {
-		log.Fatalf("Invalid snowflake for $%s: %v", env, err)
+		fatal("invalid snowflake for $"+env, "err", err)
 	}
 	return s
 }
 
+func envOr(name, fallback string) string {
+	if s := os.Getenv(name); s != "" {
+		return s
+	}
+	return fallback
+}
+
 func mustEnv(name string) string {
 	s := os.Getenv(name)
 	if s == "" {
-		log.Fatalln("No environment variable named", name)
+		fatal("no environment variable named $" + name)
 	}
 	return s
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registerTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_register_total",
+		Help: "Outcomes of /register.",
+	}, []string{"outcome"})
+	verifyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_verify_total",
+		Help: "Outcomes of /verify. Verifications that unverified the email's old account are counted as replaced.",
+	}, []string{"outcome"})
+	banTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_ban_total",
+		Help: "Outcomes of /ban, by whether a user, an email or a file was banned.",
+	}, []string{"kind", "outcome"})
+	emailsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_emails_total",
+		Help: "Attempts to send verification emails. Failed emails are retried until they're dead.",
+	}, []string{"outcome"})
+
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gatekeeper_command_duration_seconds",
+		Help:    "How long command handlers take to come up with a response.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+	// Argon2 is meant to be slow, so this starts higher than the defaults
+	identifierDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gatekeeper_identifier_duration_seconds",
+		Help:    "How long hashing an email into an identifier takes.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	})
+)
+
+// guildCollector reports gauges for each guild that are counted from the
+// store whenever metrics are scraped, so they're right across restarts and
+// replicas.
+type guildCollector struct {
+	store         Store
+	pendingTokens *prometheus.Desc
+	verifiedUsers *prometheus.Desc
+}
+
+func newGuildCollector(store Store) *guildCollector {
+	return &guildCollector{
+		store: store,
+		pendingTokens: prometheus.NewDesc(
+			"gatekeeper_pending_tokens",
+			"Unexpired tokens waiting to be verified.",
+			[]string{"guild"}, nil),
+		verifiedUsers: prometheus.NewDesc(
+			"gatekeeper_verified_users",
+			"Users that are verified.",
+			[]string{"guild"}, nil),
+	}
+}
+
+func (c *guildCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pendingTokens
+	ch <- c.verifiedUsers
+}
+
+func (c *guildCollector) Collect(ch chan<- prometheus.Metric) {
+	pending, err := c.store.PendingTokenCounts()
+	if err != nil {
+		slog.Error("error counting pending tokens for metrics", "err", err)
+		ch <- prometheus.NewInvalidMetric(c.pendingTokens, err)
+	}
+	for guild, n := range pending {
+		ch <- prometheus.MustNewConstMetric(c.pendingTokens, prometheus.GaugeValue, float64(n), guild.String())
+	}
+
+	verified, err := c.store.VerifiedCounts()
+	if err != nil {
+		slog.Error("error counting verified users for metrics", "err", err)
+		ch <- prometheus.NewInvalidMetric(c.verifiedUsers, err)
+	}
+	for guild, n := range verified {
+		ch <- prometheus.MustNewConstMetric(c.verifiedUsers, prometheus.GaugeValue, float64(n), guild.String())
+	}
+}
+
+// NewMetricsHandler serves every metric, including the ones counted from
+// store, in Prometheus' format.
+func NewMetricsHandler(store Store) http.Handler {
+	prometheus.MustRegister(newGuildCollector(store))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
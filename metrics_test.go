@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	store := newTestStore(t)
+
+	const guild = discord.GuildID(1)
+	err := store.UpdateConfig(guild, "example.com", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetEmailToken(guild, 3, Identifier{1}, nil, MakeToken(), "example.com", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetVerifiedEmail(guild, Identifier{2}, 4, 2, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerTotal.WithLabelValues("email_queued").Inc()
+
+	server := httptest.NewServer(NewMetricsHandler(store))
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, line := range []string{
+		`gatekeeper_pending_tokens{guild="1"} 1`,
+		`gatekeeper_verified_users{guild="1"} 1`,
+		`gatekeeper_register_total{outcome="email_queued"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/<dialect>/NNNN_description.sql. Versions
+// start at 1 and must not have gaps. Never edit a migration that has been
+// released, add a new one instead.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrationDialect describes the parts of running migrations that differ
+// between databases.
+type migrationDialect struct {
+	// dir is the directory under migrations/ holding this dialect's schema
+	dir string
+	// tableExists returns a row if the table named $1 exists
+	tableExists string
+	// lock and unlock stop several replicas from migrating at the same time,
+	// they may be empty if the database doesn't need it
+	lock   string
+	unlock string
+}
+
+func loadMigrations(dialect migrationDialect) ([]migration, error) {
+	dir := path.Join("migrations", dialect.dir)
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s should start with a version number", name)
+		}
+		body, err := fs.ReadFile(migrationFS, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", name, err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("expected migration version %d, got %s", i+1, m.name)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate brings the schema up to date, applying each pending migration in its
+// own transaction. It refuses to touch a database with a newer schema than
+// this binary knows about.
+func migrate(dbConn *sql.DB, dialect migrationDialect) error {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := dbConn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if dialect.lock != "" {
+		_, err = conn.ExecContext(ctx, dialect.lock)
+		if err != nil {
+			return fmt.Errorf("error locking db for migrations: %w", err)
+		}
+		defer conn.ExecContext(ctx, dialect.unlock)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (version)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// databases made with clear-db.sh before migrations were tracked already
+	// have the first migration applied
+	if current == 0 {
+		var tmp int
+		err := conn.QueryRowContext(ctx, dialect.tableExists, "config").Scan(&tmp)
+		if err == nil {
+			s := "INSERT INTO schema_version (version, name) VALUES ($1,$2)"
+			_, err = conn.ExecContext(ctx, s, migrations[0].version, migrations[0].name)
+			if err != nil {
+				return fmt.Errorf("error adopting existing schema: %w", err)
+			}
+			current = migrations[0].version
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error checking for existing schema: %w", err)
+		}
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("db schema version %d is newer than the latest version %d this build knows about", current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		err := applyMigration(ctx, conn, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error getting schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return fmt.Errorf("error applying migration %s: %w", m.name, err)
+	}
+	s := "INSERT INTO schema_version (version, name) VALUES ($1,$2)"
+	_, err = tx.ExecContext(ctx, s, m.version, m.name)
+	if err != nil {
+		return fmt.Errorf("error recording migration %s: %w", m.name, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	store := newTestStore(t)
+
+	migrations, err := loadMigrations(testMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertVersion := func(expected int) {
+		t.Helper()
+		var actual int
+		err := store.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("expected schema version %v, got %v", expected, actual)
+		}
+	}
+	assertVersion(len(migrations))
+
+	// running again is a no-op
+	err = migrate(store.db, testMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertVersion(len(migrations))
+
+	// refuse to run on a db from the future
+	_, err = store.db.Exec("INSERT INTO schema_version (version, name) VALUES ($1,$2)", len(migrations)+1, "future.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(store.db, testMigrations())
+	if err == nil {
+		t.Error("expected migrating a newer schema to fail")
+	}
+}
+
+func TestMigrateExistingSchema(t *testing.T) {
+	dbConn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbConn.SetMaxOpenConns(1)
+	defer dbConn.Close()
+
+	// this is what clear-db.sh used to create
+	schema, err := os.ReadFile("migrations/sqlite/0001_init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbConn.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbConn.Exec("INSERT INTO config (guild, email_domain, verification_role) VALUES (1, 'example.com', 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbConn.Exec("INSERT INTO banned (guild, identifier) VALUES (1, x'0102')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(dbConn, sqliteMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = dbConn.QueryRow("SELECT COUNT(*) FROM config").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected existing config to survive migrating, got %v rows", count)
+	}
+
+	err = dbConn.QueryRow("SELECT COUNT(*) FROM banned WHERE id IS NOT NULL").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected existing bans to survive migrating, got %v rows", count)
+	}
+}
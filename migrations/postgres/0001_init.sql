@@ -0,0 +1,37 @@
+-- NOTE: keep this in sync with ../sqlite/, which is the SQLite version of the
+--       same schema. "user" is a reserved word in Postgres, so it's quoted.
+CREATE TABLE config (
+	guild BIGINT NOT NULL,
+	email_domain VARCHAR(255) NOT NULL,
+	verification_role BIGINT NOT NULL,
+	PRIMARY KEY (guild, email_domain)
+);
+
+CREATE TABLE verified (
+	guild BIGINT NOT NULL,
+	identifier BYTEA NOT NULL,
+	verification_role BIGINT NOT NULL,
+	"user" BIGINT NOT NULL,
+	UNIQUE (identifier, "user"),
+	PRIMARY KEY (guild, identifier)
+);
+
+CREATE INDEX verified_user_index ON verified (guild, "user");
+
+CREATE TABLE token (
+	guild BIGINT NOT NULL,
+	token BYTEA NOT NULL,
+	identifier BYTEA NOT NULL,
+	email_domain VARCHAR(255) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (guild, email_domain) REFERENCES config (guild, email_domain),
+	PRIMARY KEY (guild, token)
+);
+
+CREATE INDEX tokens_created_at_index ON token (created_at);
+
+CREATE TABLE banned (
+	guild BIGINT NOT NULL,
+	identifier BYTEA NOT NULL,
+	PRIMARY KEY (guild, identifier)
+);
@@ -0,0 +1,5 @@
+-- the user that requested the token, only they can use it to verify. Tokens
+-- from before this was tracked belong to nobody.
+ALTER TABLE token ADD COLUMN "user" BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX token_user_index ON token (guild, "user");
@@ -0,0 +1,16 @@
+-- wrong tokens given to /verify. The row with user 0 counts failures across
+-- the whole guild.
+CREATE TABLE verify_failure (
+	guild BIGINT NOT NULL,
+	"user" BIGINT NOT NULL,
+	-- failures since the last lockout
+	failures INTEGER NOT NULL DEFAULT 0,
+	-- lockouts so far, each one lasts twice as long as the one before
+	lockouts INTEGER NOT NULL DEFAULT 0,
+	last_failure_at BIGINT NOT NULL,
+	locked_until BIGINT,
+	PRIMARY KEY (guild, "user")
+);
+
+-- 0 means the guild doesn't have a mod log
+ALTER TABLE guild_settings ADD COLUMN mod_log_channel BIGINT NOT NULL DEFAULT 0;
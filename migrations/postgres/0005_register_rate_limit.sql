@@ -0,0 +1,20 @@
+-- every verification email sent by /register, so it can be rate limited
+CREATE TABLE email_send (
+	guild BIGINT NOT NULL,
+	"user" BIGINT NOT NULL,
+	identifier BYTEA NOT NULL,
+	sent_at BIGINT NOT NULL
+);
+
+CREATE INDEX email_send_guild_index ON email_send (guild, sent_at);
+CREATE INDEX email_send_user_index ON email_send (guild, "user", sent_at);
+CREATE INDEX email_send_identifier_index ON email_send (guild, identifier, sent_at);
+
+-- guilds' overrides of the default rate limits
+CREATE TABLE rate_limit (
+	guild BIGINT NOT NULL,
+	scope VARCHAR(16) NOT NULL,
+	max_count INTEGER NOT NULL,
+	window_seconds BIGINT NOT NULL,
+	PRIMARY KEY (guild, scope)
+);
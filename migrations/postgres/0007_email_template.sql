@@ -0,0 +1,12 @@
+-- guilds' customizations of the verification email, empty means the default
+CREATE TABLE email_template (
+	guild BIGINT NOT NULL,
+	subject TEXT NOT NULL DEFAULT '',
+	intro TEXT NOT NULL DEFAULT '',
+	support_contact TEXT NOT NULL DEFAULT '',
+	text_body TEXT NOT NULL DEFAULT '',
+	html_body TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (guild)
+);
+
+ALTER TABLE outbox ADD COLUMN html_body TEXT NOT NULL DEFAULT '';
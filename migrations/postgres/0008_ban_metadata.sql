@@ -0,0 +1,13 @@
+-- bans get an id for /unban, and remember who did it and why. Bans from
+-- before this have no metadata.
+ALTER TABLE banned
+	ADD COLUMN id BIGSERIAL UNIQUE,
+	-- the account that was verified with the identifier, 0 if unknown
+	ADD COLUMN "user" BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN moderator BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN reason TEXT NOT NULL DEFAULT '',
+	ADD COLUMN created_at BIGINT,
+	-- NULL for bans that never expire
+	ADD COLUMN expires_at BIGINT;
+
+CREATE INDEX banned_user_index ON banned (guild, "user");
@@ -0,0 +1,6 @@
+-- identifiers now start with a version byte, except for version 0 which is
+-- stored the way it always was. Tokens remember every other identifier their
+-- email may already be stored under, from older identifier versions or older
+-- mailbox rules, so that they can be rehashed once it's verified. They're
+-- stored as hex separated by spaces.
+ALTER TABLE token ADD COLUMN previous_identifiers TEXT;
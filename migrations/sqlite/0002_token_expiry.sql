@@ -0,0 +1,11 @@
+-- tokens made before expiry was tracked are treated as already expired
+ALTER TABLE token ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX token_expires_at_index ON token (expires_at);
+
+CREATE TABLE guild_settings (
+	guild BIGINT NOT NULL,
+	-- how long a verification token is valid for, in seconds
+	token_ttl BIGINT NOT NULL DEFAULT 900,
+	PRIMARY KEY (guild)
+);
@@ -0,0 +1,24 @@
+-- emails waiting to be sent by the outbox workers. Once an email is sent or
+-- given up on, its recipient and body are cleared so that raw addresses and
+-- tokens don't stick around.
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	guild BIGINT NOT NULL,
+	"user" BIGINT NOT NULL,
+	-- the interaction to edit with the result
+	app_id BIGINT NOT NULL,
+	interaction_token TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	-- pending, sending, sent or dead
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	-- a worker that dies while sending loses its claim after this
+	locked_until BIGINT,
+	last_error TEXT,
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX outbox_status_index ON outbox (status, next_attempt_at);
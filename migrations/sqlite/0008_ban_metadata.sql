@@ -0,0 +1,24 @@
+-- bans get an id for /unban, and remember who did it and why. SQLite can't
+-- add a primary key to an existing table, so the table is rebuilt. Bans from
+-- before this have no metadata.
+CREATE TABLE banned_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	guild BIGINT NOT NULL,
+	identifier BINARY(32) NOT NULL,
+	-- the account that was verified with the identifier, 0 if unknown
+	"user" BIGINT NOT NULL DEFAULT 0,
+	moderator BIGINT NOT NULL DEFAULT 0,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at BIGINT,
+	-- NULL for bans that never expire
+	expires_at BIGINT,
+	UNIQUE (guild, identifier)
+);
+
+INSERT INTO banned_new (guild, identifier) SELECT guild, identifier FROM banned;
+
+DROP TABLE banned;
+
+ALTER TABLE banned_new RENAME TO banned;
+
+CREATE INDEX banned_user_index ON banned (guild, "user");
@@ -0,0 +1,5 @@
+-- remember which domain and when each user verified, for /status. Users that
+-- verified before this have an empty domain and no time.
+ALTER TABLE verified ADD COLUMN email_domain VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE verified ADD COLUMN verified_at BIGINT;
@@ -0,0 +1,13 @@
+-- every /lookup, so that moderators looking up emails are accountable. Only
+-- the identifier is kept, never the email that was looked up.
+CREATE TABLE lookup_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	guild BIGINT NOT NULL,
+	moderator BIGINT NOT NULL,
+	identifier BINARY(32) NOT NULL,
+	-- the user the email was verified by, 0 if nobody
+	found_user BIGINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX lookup_audit_guild_index ON lookup_audit (guild, created_at);
@@ -0,0 +1,5 @@
+-- how addresses of a domain are canonicalized before they're hashed into
+-- identifiers. NULL means the built-in rules for the domain are used.
+ALTER TABLE config ADD COLUMN tag_separators VARCHAR(8);
+
+ALTER TABLE config ADD COLUMN ignore_dots SMALLINT;
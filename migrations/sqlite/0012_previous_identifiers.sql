@@ -0,0 +1,8 @@
+-- identifiers now start with a version byte, except for version 0 which is
+-- stored the way it always was. Tokens remember every other identifier their
+-- email may already be stored under, from older identifier versions or older
+-- mailbox rules, so that they can be rehashed once it's verified. They're
+-- stored as hex separated by spaces.
+-- SQLite doesn't enforce the length of BINARY(32), so the other identifier
+-- columns can hold versioned identifiers as they are.
+ALTER TABLE token ADD COLUMN previous_identifiers TEXT;
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// OutboxEmail is an email waiting in the outbox, along with the interaction
+// to report back to once it's been sent.
+type OutboxEmail struct {
+	ID               int64
+	Guild            discord.GuildID
+	User             discord.UserID
+	AppID            discord.AppID
+	InteractionToken string
+	Email            Email
+	// Attempts includes the one in progress
+	Attempts int
+}
+
+const (
+	// emails are given up on after this many attempts
+	outboxMaxAttempts = 5
+	// the first retry waits this long, each one after that doubles
+	outboxRetryBase = 30 * time.Second
+	// how long a worker has to send an email before someone else can take it
+	outboxLease = 2 * time.Minute
+	// workers check for due retries and other replicas' emails this often
+	outboxPollInterval = 5 * time.Second
+)
+
+// Outbox sends emails in the background, retrying them until they're sent.
+// Emails are stored in the DB first, so they survive restarts.
+type Outbox struct {
+	s *state.State
+	// health is told how sending goes, for readiness
+	health *Health
+	wake   chan struct{}
+	stop   chan struct{}
+	// halt stops workers from taking any more emails
+	halt chan struct{}
+	wg   sync.WaitGroup
+}
+
+var outbox *Outbox
+
+func NewOutbox(s *state.State, health *Health) *Outbox {
+	return &Outbox{
+		s:      s,
+		health: health,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		halt:   make(chan struct{}),
+	}
+}
+
+func (o *Outbox) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		o.wg.Add(1)
+		go o.work()
+	}
+}
+
+// Enqueue stores the email and wakes up a worker to send it.
+func (o *Outbox) Enqueue(e OutboxEmail) error {
+	_, err := db.EnqueueEmail(e)
+	if err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Shutdown stops the workers once they have sent every email that's due.
+// Retries that aren't due yet are left for the next time the bot starts. If
+// ctx is done first, emails that haven't been started on are left too, but
+// Shutdown still waits for the ones being sent so they're marked as sent.
+func (o *Outbox) Shutdown(ctx context.Context) error {
+	close(o.stop)
+
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(o.halt)
+		<-done
+		return fmt.Errorf("outbox didn't drain in time: %w", ctx.Err())
+	}
+}
+
+func (o *Outbox) work() {
+	defer o.wg.Done()
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		o.sendDue()
+		select {
+		case <-o.stop:
+			o.sendDue()
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendDue sends emails until there are none left that are due.
+func (o *Outbox) sendDue() {
+	for {
+		select {
+		case <-o.halt:
+			return
+		default:
+		}
+		e, ok, err := db.ClaimEmail(outboxLease)
+		if err != nil {
+			slog.Error("error claiming email from outbox", "err", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		o.deliver(e)
+	}
+}
+
+func (o *Outbox) deliver(e OutboxEmail) {
+	sendErr := mailer.Send(e.Email)
+	o.health.RecordSend(sendErr)
+	if sendErr == nil {
+		emailsTotal.WithLabelValues("sent").Inc()
+		err := db.MarkEmailSent(e.ID)
+		if err != nil {
+			slog.Error("error marking email as sent", "outbox_id", e.ID, "err", err)
+		}
+		const format = "✅ An email has been sent to %v\nPlease use /verify <token> to verify your email address."
+		o.notify(e, fmt.Sprintf(format, e.Email.To))
+		return
+	}
+
+	if e.Attempts >= outboxMaxAttempts {
+		emailsTotal.WithLabelValues("dead").Inc()
+		slog.Error("giving up on email", "outbox_id", e.ID, "guild", e.Guild, "user", e.User, "attempts", e.Attempts, "err", sendErr)
+		err := db.MarkEmailDead(e.ID, redact(sendErr.Error()))
+		if err != nil {
+			slog.Error("error marking email as dead", "outbox_id", e.ID, "err", err)
+		}
+		o.notify(e, "⚠️ Error sending email :( Please check your email address and try /register again later.")
+		return
+	}
+
+	emailsTotal.WithLabelValues("failed").Inc()
+	retryAt := time.Now().Add(outboxRetryDelay(e.Attempts))
+	slog.Warn("error sending email, retrying", "outbox_id", e.ID, "guild", e.Guild, "user", e.User, "attempts", e.Attempts, "retry_at", retryAt, "err", sendErr)
+	// mail servers like to quote the address back in errors
+	err := db.RetryEmail(e.ID, retryAt, redact(sendErr.Error()))
+	if err != nil {
+		slog.Error("error scheduling retry for email", "outbox_id", e.ID, "err", err)
+	}
+}
+
+// outboxRetryDelay is how long to wait after the nth failed attempt.
+func outboxRetryDelay(attempts int) time.Duration {
+	return outboxRetryBase << (attempts - 1)
+}
+
+// notify tells the user how sending went by editing their /register response.
+// Interaction tokens only last 15 minutes, so DM them if that doesn't work.
+func (o *Outbox) notify(e OutboxEmail, msg string) {
+	data := api.EditInteractionResponseData{Content: option.NewNullableString(msg)}
+	_, err := o.s.EditInteractionResponse(e.AppID, e.InteractionToken, data)
+	if err == nil {
+		return
+	}
+
+	dm, dmErr := o.s.CreatePrivateChannel(e.User)
+	if dmErr == nil {
+		_, dmErr = o.s.SendMessage(dm.ID, msg)
+	}
+	if dmErr != nil {
+		slog.Error("couldn't edit the interaction response or DM the user", "guild", e.Guild, "user", e.User, "err", err, "dm_err", dmErr)
+	}
+}
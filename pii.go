@@ -2,22 +2,125 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
 	"encoding"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/diamondburned/arikawa/v3/discord"
 	"golang.org/x/crypto/argon2"
 )
 
-const IdentifierLength = 32
+// IdentifierLength is a version byte followed by the hash
+const IdentifierLength = 1 + identifierHashLength
 
+const identifierHashLength = 32
+
+// Identifier is a one way hash of an email, so that emails can be recognized
+// without being stored. The first byte is the version of the hash, so that
+// the way identifiers are made can change without forgetting old ones.
 type Identifier [IdentifierLength]byte
 
+const (
+	// identifierV0 is Argon2id of the email, salted with the guild. These were
+	// stored before identifiers had versions, so they're stored without the
+	// version byte.
+	identifierV0 = 0
+	// identifierV1 is identifierV0 with the email first run through an HMAC
+	// keyed by the pepper, so that the database alone isn't enough to guess
+	// emails.
+	identifierV1 = 1
+)
+
+// pepper is a secret mixed into identifiers that lives outside of the
+// database. Without one, identifiers are made the old way. It can't be
+// rotated: emails aren't stored, so identifiers made with an old pepper can
+// never be remade with a new one.
+var pepper []byte
+
+const minPepperLength = 16
+
+// LoadPepper reads the pepper from $IDENTIFIER_PEPPER, or from the file named
+// by $IDENTIFIER_PEPPER_FILE.
+func LoadPepper() ([]byte, error) {
+	secret := os.Getenv("IDENTIFIER_PEPPER")
+	if path := os.Getenv("IDENTIFIER_PEPPER_FILE"); path != "" {
+		if secret != "" {
+			return nil, fmt.Errorf("only one of $IDENTIFIER_PEPPER and $IDENTIFIER_PEPPER_FILE can be set")
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading pepper: %w", err)
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < minPepperLength {
+		return nil, fmt.Errorf("pepper should be at least %v characters", minPepperLength)
+	}
+	return []byte(secret), nil
+}
+
+// currentIdentifierVersion is the version new identifiers are made with.
+func currentIdentifierVersion() byte {
+	if pepper == nil {
+		return identifierV0
+	}
+	return identifierV1
+}
+
 // email should already be validated
 func MakeIdentifier(guild discord.GuildID, email string) (Identifier, error) {
+	return makeIdentifierVersion(guild, email, currentIdentifierVersion())
+}
+
+// legacyIdentifiers makes the identifiers that email may have been stored
+// under before the current version, newest first.
+func legacyIdentifiers(guild discord.GuildID, email string) ([]Identifier, error) {
+	var ids []Identifier
+	for version := int(currentIdentifierVersion()) - 1; version >= identifierV0; version-- {
+		id, err := makeIdentifierVersion(guild, email, byte(version))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// previousIdentifiers makes every identifier besides the current one that an
+// email matched by config may already be stored under: those of older
+// identifier versions, and those of the address under the domain's older
+// mailbox rules. The first of mailboxVariants is the canonical address.
+func previousIdentifiers(guild discord.GuildID, config DomainConfig, email string) ([]Identifier, error) {
+	var ids []Identifier
+	for i, variant := range mailboxVariants(config, email) {
+		if i > 0 {
+			id, err := MakeIdentifier(guild, variant)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		legacy, err := legacyIdentifiers(guild, variant)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, legacy...)
+	}
+	return ids, nil
+}
+
+func makeIdentifierVersion(guild discord.GuildID, email string, version byte) (Identifier, error) {
 	// these parameters were recommended by the docs for argon2.IDKey
 	// https://pkg.go.dev/golang.org/x/crypto/argon2#IDKey
 	const argon2Time = 1
@@ -27,26 +130,54 @@ func MakeIdentifier(guild discord.GuildID, email string) (Identifier, error) {
 	guildBytes := new(bytes.Buffer)
 	binary.Write(guildBytes, binary.BigEndian, uint64(guild))
 
+	password := []byte(email)
+	switch version {
+	case identifierV0:
+	case identifierV1:
+		if pepper == nil {
+			return Identifier{}, fmt.Errorf("identifier version %v needs a pepper", version)
+		}
+		mac := hmac.New(sha256.New, pepper)
+		mac.Write(password)
+		password = mac.Sum(nil)
+	default:
+		return Identifier{}, fmt.Errorf("unknown identifier version %v", version)
+	}
+
+	start := time.Now()
 	tokenSlice := argon2.IDKey(
-		[]byte(email),
+		password,
 		guildBytes.Bytes(),
 		argon2Time,
 		argon2Mem,
 		argon2Threads,
-		IdentifierLength,
+		identifierHashLength,
 	)
+	identifierDuration.Observe(time.Since(start).Seconds())
 
-	if len(tokenSlice) != IdentifierLength {
+	if len(tokenSlice) != identifierHashLength {
 		return Identifier{},
-			fmt.Errorf("token should be %v bytes", IdentifierLength)
+			fmt.Errorf("token should be %v bytes", identifierHashLength)
 	}
 
-	token := Identifier{}
-	copy(token[:], tokenSlice)
+	token := Identifier{version}
+	copy(token[1:], tokenSlice)
 
 	return token, nil
 }
 
+func (i Identifier) Version() byte {
+	return i[0]
+}
+
+// Bytes is how the identifier is stored.
+func (i Identifier) Bytes() []byte {
+	if i.Version() == identifierV0 {
+		return i[1:]
+	}
+	return i[:]
+}
+
 // for use as a value or map key in JSON
 // https://pkg.go.dev/encoding/json#Marshal
 // https://pkg.go.dev/encoding/json#Unmarshal
@@ -54,27 +185,41 @@ var _ encoding.TextMarshaler = Identifier{}    // must be value (for write)
 var _ encoding.TextUnmarshaler = &Identifier{} // must be pointer (for read)
 
 func (i *Identifier) UnmarshalText(b []byte) error {
-	n, err := base64.StdEncoding.Decode(i[:], b)
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(buf, b)
 	if err != nil {
 		return err
 	}
-	if n != len(i) {
-		return fmt.Errorf("bytes should have length %v", len(i))
-	}
-	return nil
+	_, err = i.Write(buf[:n])
+	return err
 }
 
 func (i Identifier) MarshalText() ([]byte, error) {
-	return []byte(base64.StdEncoding.EncodeToString(i[:])), nil
+	return []byte(base64.StdEncoding.EncodeToString(i.Bytes())), nil
 }
 
 // for parsing from a []byte
 var _ io.Writer = &Identifier{}
 
 func (i *Identifier) Write(p []byte) (n int, err error) {
-	if len(p) != len(i) {
-		return 0, fmt.Errorf("bytes should have length %v", len(i))
+	switch len(p) {
+	case identifierHashLength:
+		// unversioned, so it's from before versions
+		*i = Identifier{identifierV0}
+		copy(i[1:], p)
+		return len(p), nil
+	case IdentifierLength:
+		if p[0] == identifierV0 {
+			return 0, fmt.Errorf("version %v identifiers should have length %v", identifierV0, identifierHashLength)
+		}
+		return copy(i[:], p), nil
+	default:
+		return 0, fmt.Errorf("bytes should have length %v or %v", identifierHashLength, IdentifierLength)
 	}
-	n = copy(i[:], p)
-	return
+}
+
+var _ driver.Valuer = Identifier{}
+
+func (i Identifier) Value() (driver.Value, error) {
+	return i.Bytes(), nil
 }
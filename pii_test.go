@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIdentifierVersions(t *testing.T) {
+	old := pepper
+	defer func() { pepper = old }()
+
+	pepper = nil
+	v0, err := MakeIdentifier(1, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v0.Version() != identifierV0 || len(v0.Bytes()) != identifierHashLength {
+		t.Errorf("expected an unversioned identifier without a pepper, got version %v with %v bytes", v0.Version(), len(v0.Bytes()))
+	}
+	legacy, err := legacyIdentifiers(1, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 0 {
+		t.Errorf("expected no legacy identifiers without a pepper, got %v", len(legacy))
+	}
+
+	pepper = []byte("a very secret pepper")
+	v1, err := MakeIdentifier(1, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Version() != identifierV1 || len(v1.Bytes()) != IdentifierLength {
+		t.Errorf("expected a version %v identifier with a pepper, got version %v with %v bytes", identifierV1, v1.Version(), len(v1.Bytes()))
+	}
+	legacy, err = legacyIdentifiers(1, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 1 || legacy[0] != v0 {
+		t.Errorf("expected the unversioned identifier to be the legacy one, got %v", legacy)
+	}
+
+	pepper = []byte("a different pepper")
+	other, err := MakeIdentifier(1, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == v1 {
+		t.Error("expected the pepper to change the identifier")
+	}
+
+	// identifiers survive being stored
+	for _, id := range []Identifier{v0, v1} {
+		var actual Identifier
+		_, err = actual.Write(id.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != id {
+			t.Errorf("expected %v, got %v", id, actual)
+		}
+	}
+}
+
+func TestPreviousIdentifiers(t *testing.T) {
+	old := pepper
+	defer func() { pepper = old }()
+	pepper = []byte("a very secret pepper")
+
+	const email = "first.last@gmail.com"
+	const canonical = "firstlast@gmail.com"
+	previous, err := previousIdentifiers(1, DomainConfig{Domain: "gmail.com"}, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unpeppered canonical address
+	canonicalV0, err := makeIdentifierVersion(1, canonical, identifierV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the raw address, before mailboxes were canonicalized
+	raw, err := MakeIdentifier(1, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawV0, err := makeIdentifierVersion(1, email, identifierV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Identifier{canonicalV0, raw, rawV0}
+	if !reflect.DeepEqual(previous, expected) {
+		t.Errorf("expected %v, got %v", expected, previous)
+	}
+
+	// without rules, only the unpeppered address itself
+	previous, err = previousIdentifiers(1, DomainConfig{Domain: "school.edu"}, "j.smith@school.edu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0, err := makeIdentifierVersion(1, "j.smith@school.edu", identifierV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(previous, []Identifier{v0}) {
+		t.Errorf("expected only %v, got %v", v0, previous)
+	}
+}
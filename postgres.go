@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+var postgresMigrations = migrationDialect{
+	dir:         "postgres",
+	tableExists: "SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1",
+	// any constant works, it just has to be the same for every replica
+	lock:   "SELECT pg_advisory_lock(7364)",
+	unlock: "SELECT pg_advisory_unlock(7364)",
+}
+
+// PostgresStore lets several replicas of the bot share the same storage.
+type PostgresStore struct {
+	sqlStore
+}
+
+func OpenPostgres(dsn string) (*PostgresStore, error) {
+	dbConn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening db: %w", err)
+	}
+	err = dbConn.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection to DB: %w", err)
+	}
+	err = migrate(dbConn, postgresMigrations)
+	if err != nil {
+		dbConn.Close()
+		return nil, fmt.Errorf("error migrating db: %w", err)
+	}
+	return &PostgresStore{sqlStore{db: dbConn}}, nil
+}
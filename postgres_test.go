@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postgresTestURL is the Postgres database to run the store tests against, or
+// "" to use SQLite.
+func postgresTestURL() string {
+	dsn := os.Getenv("DATABASE_URL")
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return dsn
+	}
+	return ""
+}
+
+// newPostgresTestStore migrates a schema of its own for a test, and drops it
+// once the test is done.
+func newPostgresTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	dsn := postgresTestURL()
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("gatekeeper_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if err != nil {
+			t.Errorf("error dropping test schema: %v", err)
+		}
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	store, err := OpenPostgres(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// registered last so that it runs before the schema is dropped
+	t.Cleanup(func() { store.Close() })
+	return store
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteMigrations = migrationDialect{
+	dir:         "sqlite",
+	tableExists: "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1",
+}
+
+type SQLiteStore struct {
+	sqlStore
+}
+
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	// no need for _loc=auto, since we should use discord time things
+	// https://discord.com/developers/docs/reference#message-formatting
+	dbConn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening db: %w", err)
+	}
+	// SQLite only allows a single writer, and every connection to :memory: is
+	// a brand new database, so stick to one connection
+	dbConn.SetMaxOpenConns(1)
+
+	err = dbConn.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection to DB: %w", err)
+	}
+	err = migrate(dbConn, sqliteMigrations)
+	if err != nil {
+		dbConn.Close()
+		return nil, fmt.Errorf("error migrating db: %w", err)
+	}
+	return &SQLiteStore{sqlStore{db: dbConn}}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Store is everything the bot needs to persist. Identifiers are stored instead
+// of emails, except in the outbox: it keeps the address, the body with its
+// token and the interaction token until the email is sent or given up on, and
+// clears them then.
+type Store interface {
+	GetEmailToken(guild discord.GuildID, token Token) (EmailToken, bool, error)
+	SetEmailToken(guild discord.GuildID, user discord.UserID, id Identifier, previous []Identifier, token Token, domain string, expiresAt time.Time) error
+	RehashIdentifier(guild discord.GuildID, from, to Identifier) error
+	DeleteEmailToken(guild discord.GuildID, token Token) error
+	DeleteUserTokens(guild discord.GuildID, user discord.UserID) error
+	PendingTokenExpiry(guild discord.GuildID, user discord.UserID) (time.Time, bool, error)
+	PendingTokenCounts() (map[discord.GuildID]int, error)
+	CleanupTokens() error
+
+	VerifyLockedUntil(guild discord.GuildID, user discord.UserID) (time.Time, error)
+	RecordVerifyFailure(guild discord.GuildID, user discord.UserID, policy LockoutPolicy) (time.Time, bool, error)
+	ResetVerifyFailures(guild discord.GuildID, user discord.UserID) error
+	CleanupVerifyFailures(before time.Time) error
+
+	RateLimits(guild discord.GuildID) (map[RateLimitScope]RateLimit, error)
+	SetRateLimit(guild discord.GuildID, scope RateLimitScope, limit RateLimit) error
+	RecordEmailSend(guild discord.GuildID, user discord.UserID, id Identifier) error
+	RecentEmailSends(guild discord.GuildID, scope RateLimitScope, user discord.UserID, id Identifier, since time.Time, n int) ([]time.Time, error)
+	CleanupEmailSends(before time.Time) error
+
+	EnqueueEmail(e OutboxEmail) (int64, error)
+	ClaimEmail(lease time.Duration) (OutboxEmail, bool, error)
+	MarkEmailSent(id int64) error
+	RetryEmail(id int64, at time.Time, lastError string) error
+	MarkEmailDead(id int64, lastError string) error
+	CleanupOutbox(before time.Time) error
+
+	EmailTemplate(guild discord.GuildID) (EmailTemplate, error)
+	SetEmailTemplate(guild discord.GuildID, t EmailTemplate) error
+	DeleteEmailTemplate(guild discord.GuildID) error
+
+	GetVerifiedEmail(guild discord.GuildID, id Identifier) (discord.UserID, bool, error)
+	SetVerifiedEmail(guild discord.GuildID, id Identifier, user discord.UserID, role discord.RoleID, domain string) error
+	DeleteVerifiedEmail(guild discord.GuildID, id Identifier) error
+	GetUserIdentifiers(guild discord.GuildID, user discord.UserID) ([]Identifier, error)
+	UserVerifications(guild discord.GuildID, user discord.UserID) ([]Verification, error)
+	VerificationRole(guild discord.GuildID, id Identifier) (discord.RoleID, bool, error)
+	VerifiedCounts() (map[discord.GuildID]int, error)
+	HasPepperedIdentifiers() (bool, error)
+
+	BanEmail(ban BanRecord) (int64, time.Time, error)
+	UnbanEmail(guild discord.GuildID, id Identifier) error
+	UnbanID(guild discord.GuildID, id int64) (bool, error)
+	UnbanUser(guild discord.GuildID, user discord.UserID) (int64, error)
+	IsBanned(guild discord.GuildID, id Identifier) (bool, error)
+	GetBan(guild discord.GuildID, id Identifier) (BanRecord, bool, error)
+	Bans(guild discord.GuildID, limit, offset int) ([]BanRecord, error)
+	CountBans(guild discord.GuildID) (int, error)
+	PurgeExpiredBans(now time.Time) ([]BanRecord, error)
+
+	UpdateConfig(guild discord.GuildID, domain string, role discord.RoleID) error
+	DeleteConfig(guild discord.GuildID, domain string) error
+	GetConfig(guild discord.GuildID, domain string) (discord.RoleID, bool, error)
+	EmailDomains(guild discord.GuildID) ([]DomainConfig, error)
+	SetMailboxRules(guild discord.GuildID, domain string, rules *MailboxRules) error
+	CountDomainTokens(guild discord.GuildID, domain string) (int, error)
+	DeleteDomainTokens(guild discord.GuildID, domain string) error
+
+	RecordLookup(guild discord.GuildID, moderator discord.UserID, id Identifier, found discord.UserID) error
+
+	GuildSettings(guild discord.GuildID) (GuildSettings, error)
+	SetTokenTTL(guild discord.GuildID, ttl time.Duration) error
+	SetModLogChannel(guild discord.GuildID, channel discord.ChannelID) error
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var _ Store = &SQLiteStore{}
+var _ Store = &PostgresStore{}
+
+var db Store
+
+const defaultDSN = "db.sqlite"
+
+// InitDB opens the store described by $DATABASE_URL. Postgres URLs
+// (postgres:// or postgresql://) use Postgres, anything else is treated as a
+// path to an SQLite database, optionally prefixed with sqlite://.
+func InitDB() (Store, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = defaultDSN
+	}
+	return OpenStore(dsn)
+}
+
+func OpenStore(dsn string) (Store, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return OpenPostgres(dsn)
+	default:
+		return OpenSQLite(strings.TrimPrefix(dsn, "sqlite://"))
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
+)
+
+// EmailTemplate is a guild's customization of the verification email. Empty
+// fields use the default.
+//
+// Subject, Text and HTML are Go templates
+// (https://pkg.go.dev/text/template) executed with EmailData. HTML is escaped
+// with html/template. Intro and SupportContact are plain text that the
+// default templates fill in.
+type EmailTemplate struct {
+	Subject        string
+	Intro          string
+	SupportContact string
+	Text           string
+	HTML           string
+}
+
+// EmailData is everything a template can use. It's all strings on purpose, so
+// templates can't call anything.
+type EmailData struct {
+	Token     string
+	GuildName string
+	// Expiry is how long the token lasts, like "15 minutes"
+	Expiry    string
+	Requester string
+
+	Intro          string
+	SupportContact string
+}
+
+const defaultSubjectTemplate = `{{.GuildName}} verification`
+
+const defaultTextTemplate = `Greetings from Gatekeeper!
+{{if .Intro}}
+{{.Intro}}
+{{end}}
+Your verification token for {{.GuildName}} is: {{.Token}}
+It expires in {{.Expiry}}. Use /verify in the server to finish verifying {{.Requester}}.
+{{if .SupportContact}}
+If you need help, contact {{.SupportContact}}.
+{{end}}`
+
+const defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<p>Greetings from Gatekeeper!</p>
+{{if .Intro}}<p>{{.Intro}}</p>
+{{end}}<p>Your verification token for <strong>{{.GuildName}}</strong> is:</p>
+<p style="font-size: 1.5em; font-family: monospace;">{{.Token}}</p>
+<p>It expires in {{.Expiry}}. Use <code>/verify</code> in the server to finish verifying {{.Requester}}.</p>
+{{if .SupportContact}}<p>If you need help, contact {{.SupportContact}}.</p>
+{{end}}</body>
+</html>
+`
+
+// templates that write too much are stopped, so they can't use up memory
+const maxTemplateOutput = 64 * 1024
+
+var (
+	errTemplateTooLong = errors.New("email template output is too long")
+	// there's nothing in EmailData to loop over, and a loop that writes
+	// nothing could run forever without hitting the output limit
+	errTemplateLoops = errors.New("email templates can't use range, template or block")
+	errNoToken       = errors.New("email templates have to include {{.Token}}")
+)
+
+// checkNoLoops makes sure a template can't run for long, by rejecting
+// anything that repeats.
+func checkNoLoops(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, n := range node.Nodes {
+			if err := checkNoLoops(n); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranchLoops(&node.BranchNode)
+	case *parse.WithNode:
+		return checkBranchLoops(&node.BranchNode)
+	case *parse.RangeNode, *parse.TemplateNode:
+		return errTemplateLoops
+	}
+	return nil
+}
+
+func checkBranchLoops(node *parse.BranchNode) error {
+	if err := checkNoLoops(node.List); err != nil {
+		return err
+	}
+	return checkNoLoops(node.ElseList)
+}
+
+// limitedWriter fails once more than n bytes have been written to it, which
+// stops template execution.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, errTemplateTooLong
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+// executor is either a text or HTML template.
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+func executeTemplate(t executor, data EmailData) (string, error) {
+	buf := &bytes.Buffer{}
+	err := t.Execute(&limitedWriter{w: buf, n: maxTemplateOutput}, data)
+	return buf.String(), err
+}
+
+func orDefault(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// RenderEmail fills in the guild's template, also checking that it's valid.
+func RenderEmail(tmpl EmailTemplate, data EmailData) (Email, error) {
+	data.Intro = tmpl.Intro
+	data.SupportContact = tmpl.SupportContact
+
+	subjectTmpl, err := texttemplate.New("subject").Parse(orDefault(tmpl.Subject, defaultSubjectTemplate))
+	if err != nil {
+		return Email{}, err
+	}
+	textTmpl, err := texttemplate.New("text").Parse(orDefault(tmpl.Text, defaultTextTemplate))
+	if err != nil {
+		return Email{}, err
+	}
+	htmlTmpl, err := htmltemplate.New("html").Parse(orDefault(tmpl.HTML, defaultHTMLTemplate))
+	if err != nil {
+		return Email{}, err
+	}
+	for _, tree := range []*parse.Tree{subjectTmpl.Tree, textTmpl.Tree, htmlTmpl.Tree} {
+		if err := checkNoLoops(tree.Root); err != nil {
+			return Email{}, err
+		}
+	}
+
+	subject, err := executeTemplate(subjectTmpl, data)
+	if err != nil {
+		return Email{}, err
+	}
+	text, err := executeTemplate(textTmpl, data)
+	if err != nil {
+		return Email{}, err
+	}
+	html, err := executeTemplate(htmlTmpl, data)
+	if err != nil {
+		return Email{}, err
+	}
+
+	return Email{
+		// headers can't have newlines in them
+		Subject: strings.Join(strings.Fields(subject), " "),
+		Body:    strings.TrimSpace(text),
+		HTML:    html,
+	}, nil
+}
+
+// CheckEmailTemplate makes sure a template renders and that the token makes it
+// into both bodies, since the email is useless without it.
+func CheckEmailTemplate(tmpl EmailTemplate, data EmailData) error {
+	email, err := RenderEmail(tmpl, data)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(email.Body, data.Token) || !strings.Contains(email.HTML, data.Token) {
+		return errNoToken
+	}
+	return nil
+}
+
+// truncateRunes cuts s down to at most n characters for previews, marking that it was cut.
+func truncateRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n]) + "\n..."
+	}
+	return s
+}
+
+// sampleEmailData is used to preview and check templates.
+func sampleEmailData(guildName, requester string) EmailData {
+	token := MakeToken()
+	return EmailData{
+		Token:     token.String(),
+		GuildName: guildName,
+		Expiry:    formatDuration(defaultTokenTTL),
+		Requester: requester,
+	}
+}
+
+func newEmailData(token Token, guildName, requester string, ttl time.Duration) EmailData {
+	return EmailData{
+		Token:     token.String(),
+		GuildName: guildName,
+		Expiry:    formatDuration(ttl),
+		Requester: requester,
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEmailDefault(t *testing.T) {
+	data := EmailData{
+		Token:     "0123456789ABC",
+		GuildName: "VikeLabs",
+		Expiry:    "15 minutes",
+		Requester: "someone#1234",
+	}
+	tmpl := EmailTemplate{
+		Intro:          "Welcome to <VikeLabs>!",
+		SupportContact: "mods@example.com",
+	}
+
+	email, err := RenderEmail(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email.Subject != "VikeLabs verification" {
+		t.Errorf("unexpected subject %q", email.Subject)
+	}
+	for _, expected := range []string{data.Token, data.Expiry, data.Requester, tmpl.Intro, tmpl.SupportContact} {
+		if !strings.Contains(email.Body, expected) {
+			t.Errorf("expected text to contain %q, got:\n%s", expected, email.Body)
+		}
+	}
+	if !strings.Contains(email.HTML, data.Token) {
+		t.Errorf("expected HTML to contain the token, got:\n%s", email.HTML)
+	}
+	if !strings.Contains(email.HTML, "Welcome to &lt;VikeLabs&gt;!") {
+		t.Errorf("expected intro to be escaped in HTML, got:\n%s", email.HTML)
+	}
+}
+
+func TestRenderEmailCustom(t *testing.T) {
+	tmpl := EmailTemplate{
+		Subject: "Welcome\nto {{.GuildName}}",
+		Text:    "token: {{.Token}}",
+		HTML:    "<a href=\"https://example.com/?q={{.Requester}}\">{{.Token}}</a>",
+	}
+	email, err := RenderEmail(tmpl, EmailData{Token: "TOKEN", GuildName: "VikeLabs", Requester: "a b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Subject != "Welcome to VikeLabs" {
+		t.Errorf("expected newlines to be removed from the subject, got %q", email.Subject)
+	}
+	if email.Body != "token: TOKEN" {
+		t.Errorf("unexpected text %q", email.Body)
+	}
+	if !strings.Contains(email.HTML, "q=a%20b") {
+		t.Errorf("expected requester to be escaped in the URL, got %q", email.HTML)
+	}
+}
+
+func TestRenderEmailInvalid(t *testing.T) {
+	tests := map[string]EmailTemplate{
+		"unparseable":     {Text: "{{.Token"},
+		"unknown field":   {Text: "{{.Email}}"},
+		"calls function":  {Text: "{{call .Token}}"},
+		"too long output": {Text: `{{printf "%0100000d" 1}}`},
+		"loops":           {Text: "{{range 100000000}}{{end}}"},
+		"nested loops":    {HTML: "{{if .Token}}{{range 100000000}}{{end}}{{end}}"},
+		"recurses":        {Text: `{{define "a"}}{{template "a" .}}{{end}}{{template "a" .}}`},
+	}
+	for name, tmpl := range tests {
+		_, err := RenderEmail(tmpl, EmailData{Token: "TOKEN"})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCheckEmailTemplate(t *testing.T) {
+	data := EmailData{Token: "TOKEN", GuildName: "VikeLabs"}
+	if err := CheckEmailTemplate(EmailTemplate{}, data); err != nil {
+		t.Errorf("expected the default template to be fine, got %v", err)
+	}
+
+	tests := map[string]EmailTemplate{
+		"no token in text":      {Text: "Welcome to {{.GuildName}}"},
+		"no token in HTML":      {HTML: "<p>Welcome to {{.GuildName}}</p>"},
+		"token behind an if":    {Text: "{{if .Intro}}{{.Token}}{{end}}"},
+		"token in subject only": {Subject: "{{.Token}}", Text: "hi", HTML: "hi"},
+	}
+	for name, tmpl := range tests {
+		if err := CheckEmailTemplate(tmpl, data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	if s := truncateRunes("short", 10); s != "short" {
+		t.Errorf("expected short strings to be left alone, got %q", s)
+	}
+	s := truncateRunes(strings.Repeat("é", 10), 5)
+	if s != strings.Repeat("é", 5)+"\n..." {
+		t.Errorf("expected to be cut after 5 characters, got %q", s)
+	}
+}